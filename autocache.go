@@ -0,0 +1,81 @@
+package fressian
+
+import "container/list"
+
+// AutoCache configures which values a Writer caches on its own, in
+// addition to those written using WriteAs with cache set to true.
+type AutoCache struct {
+	// Keywords caches the namespace and name of keywords, like the
+	// Clojure handlers for fressian do.
+	Keywords bool
+	// Symbols caches the namespace and name of symbols.
+	Symbols bool
+	// MaxStringLength caches strings up to that many bytes long.
+	MaxStringLength int
+	// Candidates only caches strings that occurred among the last
+	// Candidates distinct strings written, so that strings that are
+	// only written once don't take up cache entries.  If it is 0,
+	// strings are cached the first time they are written.
+	Candidates int
+	// MaxEntries bounds the number of cache entries: once the caches
+	// hold more, the Writer resets them before the next top-level
+	// value, like WithCacheLimit does.  If it is 0,
+	// DefaultAutoCacheEntries is used.  If it is negative, the caches
+	// grow without bound, like they do in Java.
+	MaxEntries int
+}
+
+// DefaultAutoCacheEntries is the number of cache entries a Writer
+// using an AutoCache keeps at most, unless AutoCache.MaxEntries says
+// otherwise.
+const DefaultAutoCacheEntries = 4096
+
+// limit returns l, lowered to MaxEntries entries.
+func (ac *AutoCache) limit(l cacheLimit) cacheLimit {
+	max := ac.MaxEntries
+	if max == 0 {
+		max = DefaultAutoCacheEntries
+	}
+	if max > 0 && (l.entries == 0 || max < l.entries) {
+		l.entries = max
+	}
+	return l
+}
+
+// autoCacher keeps track of the strings that are candidates for
+// caching.
+type autoCacher struct {
+	AutoCache
+	recent     *list.List
+	candidates map[string]*list.Element
+}
+
+func newAutoCacher(ac *AutoCache) *autoCacher {
+	if ac == nil {
+		return nil
+	}
+	return &autoCacher{*ac, list.New(), make(map[string]*list.Element)}
+}
+
+// cacheString reports whether s, which is no longer than
+// MaxStringLength, should be cached.  cached is true if s already has
+// a cache entry.
+func (ac *autoCacher) cacheString(s string, cached bool) bool {
+	if cached || ac.Candidates <= 0 {
+		return true
+	}
+
+	if e, ok := ac.candidates[s]; ok {
+		ac.recent.Remove(e)
+		delete(ac.candidates, s)
+		return true
+	}
+
+	ac.candidates[s] = ac.recent.PushFront(s)
+	if ac.recent.Len() > ac.Candidates {
+		oldest := ac.recent.Back()
+		ac.recent.Remove(oldest)
+		delete(ac.candidates, oldest.Value.(string))
+	}
+	return false
+}
@@ -0,0 +1,172 @@
+package fressian
+
+import (
+	"errors"
+	"fmt"
+)
+
+// frame is a collection started with one of the Begin methods of
+// Writer, whose elements are being written.
+type frame struct {
+	kind frameKind
+	// depth is the depth of the elements of the collection
+	depth int
+	// remaining is the number of elements still to be written, or -1
+	// if the number isn't known in advance
+	remaining int
+	count     int
+}
+
+type frameKind byte
+
+const (
+	frameList frameKind = iota
+	frameMap
+	frameSet
+	frameStruct
+	frameClosedMap
+	frameClosedList
+)
+
+func (k frameKind) String() string {
+	switch k {
+	case frameList:
+		return "list"
+	case frameMap:
+		return "map"
+	case frameSet:
+		return "set"
+	case frameStruct:
+		return "struct"
+	case frameClosedMap:
+		return "closed map"
+	case frameClosedList:
+		return "closed list"
+	default:
+		return "unknown"
+	}
+}
+
+var errCanonicalStream = errors.New("entries of maps and sets written incrementally can't be sorted in canonical mode")
+
+// BeginList starts writing a list of n elements, which are written
+// using the other methods of w.  End ends it.
+func (w *Writer) BeginList(n int) error {
+	return w.begin(frameList, n, func() {
+		w.writeListHeader(n)
+	})
+}
+
+// BeginMap starts writing a map of n entries, whose keys and values
+// are written alternately.  End ends it.
+func (w *Writer) BeginMap(n int) error {
+	if w.canonical {
+		return errCanonicalStream
+	}
+	return w.begin(frameMap, 2*n, func() {
+		w.writeCode(MAP)
+		w.writeListHeader(2 * n)
+	})
+}
+
+// BeginClosedMap starts writing a map whose number of entries isn't
+// known in advance.  End ends it.
+func (w *Writer) BeginClosedMap() error {
+	if w.canonical {
+		return errCanonicalStream
+	}
+	return w.begin(frameClosedMap, -1, func() {
+		w.writeCode(MAP)
+		w.writeCode(BEGIN_CLOSED_LIST)
+	})
+}
+
+// BeginSet starts writing a set of n elements.  End ends it.
+func (w *Writer) BeginSet(n int) error {
+	if w.canonical {
+		return errCanonicalStream
+	}
+	return w.begin(frameSet, n, func() {
+		w.writeCode(SET)
+		w.writeListHeader(n)
+	})
+}
+
+// BeginStruct starts writing a struct with tag and n fields, like
+// WriteExt does.  End ends it.
+func (w *Writer) BeginStruct(tag interface{}, n int) error {
+	return w.begin(frameStruct, n, func() {
+		w.writeTag(tag, n)
+	})
+}
+
+// begin writes the header of a collection and pushes its frame.  The
+// collection is a value that ends when End is called.
+func (w *Writer) begin(kind frameKind, n int, writeHeader func()) error {
+	if n < -1 {
+		return fmt.Errorf("negative number of elements for %s: %d", kind, n)
+	}
+
+	w.beginValue()
+	writeHeader()
+	if err := w.raw.err; err != nil {
+		w.endValue()
+		return err
+	}
+	w.frames = append(w.frames, frame{kind, w.depth, n, 0})
+	return nil
+}
+
+// End ends the collection started last using BeginList, BeginMap,
+// BeginClosedMap, BeginSet or BeginStruct.  It fails if fewer elements
+// than announced were written, in which case the collection is still
+// open, or if no collection is open.
+func (w *Writer) End() error {
+	if err := w.raw.err; err != nil {
+		return err
+	}
+	if len(w.frames) == 0 {
+		return errors.New("End called without an open collection")
+	}
+
+	f := w.frames[len(w.frames)-1]
+	switch {
+	case f.kind == frameClosedList:
+		return errors.New("End called for a closed list, use EndList")
+	case f.depth != w.depth:
+		return fmt.Errorf("End called while writing an element of a %s", f.kind)
+	case f.remaining > 0:
+		return fmt.Errorf("%s is missing %d of %d elements", f.kind, f.remaining, f.count+f.remaining)
+	case f.kind == frameClosedMap && f.count%2 != 0:
+		return errors.New("closed map is missing the value of its last entry")
+	}
+
+	if f.kind == frameClosedMap {
+		w.writeCode(END_COLLECTION)
+	}
+	w.frames = w.frames[:len(w.frames)-1]
+	w.endValue()
+	return w.raw.err
+}
+
+// countElement is called before a value is written, and counts it as
+// an element of the open collection it is in, if any.  Writing more
+// elements than announced makes writing fail.
+func (w *Writer) countElement() {
+	if len(w.frames) == 0 {
+		return
+	}
+
+	f := &w.frames[len(w.frames)-1]
+	if f.depth != w.depth {
+		return
+	}
+	if f.remaining == 0 {
+		w.fail(fmt.Errorf("too many elements for %s of %d elements", f.kind, f.count))
+		return
+	}
+	if f.remaining > 0 {
+		f.remaining--
+	}
+	f.count++
+}
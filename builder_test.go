@@ -0,0 +1,98 @@
+package fressian
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	tu "github.com/klingtnet/gol/util/testing"
+)
+
+func TestBuilder(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf, nil)
+	tu.RequireNil(t, w.BeginList(3))
+	w.WriteInt(1)
+	tu.RequireNil(t, w.BeginMap(2))
+	w.WriteString("a")
+	w.WriteValue([]interface{}{1, 2})
+	w.WriteString("b")
+	tu.RequireNil(t, w.BeginClosedMap())
+	w.WriteValue(Keyword{"", "c"})
+	w.WriteBool(true)
+	tu.RequireNil(t, w.End())
+	tu.RequireNil(t, w.End())
+	tu.RequireNil(t, w.BeginStruct("point", 2))
+	w.WriteInt(3)
+	w.WriteInt(4)
+	tu.RequireNil(t, w.End())
+	tu.RequireNil(t, w.End())
+	tu.RequireNil(t, w.Flush())
+
+	bs := buf.Bytes()
+	tu.ExpectEqual(t, bs[0], byte(LIST_PACKED_LENGTH_START+3))
+
+	res := readValue(t, bs).([]interface{})
+	tu.ExpectEqual(t, res[0], 1)
+	m := res[1].(map[interface{}]interface{})
+	tu.ExpectEqual(t, reflect.DeepEqual(m["a"], []interface{}{1, 2}), true)
+	inner := m["b"].(map[interface{}]interface{})
+	tu.ExpectEqual(t, inner[Keyword{"", "c"}], true)
+	tu.ExpectEqual(t, reflect.DeepEqual(res[2], StructAny{"point", []interface{}{3, 4}}), true)
+
+	// a set of 2 elements
+	buf = new(bytes.Buffer)
+	w = NewWriter(buf, nil)
+	tu.RequireNil(t, w.BeginSet(2))
+	w.WriteInt(1)
+	w.WriteInt(2)
+	tu.RequireNil(t, w.End())
+	w.Flush()
+	tu.ExpectEqual(t, string(buf.Bytes()), string([]byte{SET, LIST_PACKED_LENGTH_START + 2, 1, 2}))
+	set := readValue(t, buf.Bytes())
+	tu.ExpectEqual(t, reflect.DeepEqual(set, Set{1: {}, 2: {}}), true)
+
+	// and written from a Set
+	buf = new(bytes.Buffer)
+	w = NewWriter(buf, nil)
+	tu.RequireNil(t, w.WriteValue(Set{"a": {}, Keyword{"", "b"}: {}}))
+	w.Flush()
+	set = readValue(t, buf.Bytes())
+	tu.ExpectEqual(t, reflect.DeepEqual(set, Set{"a": {}, Keyword{"", "b"}: {}}), true)
+}
+
+func TestBuilderErrors(t *testing.T) {
+	w := NewWriter(new(bytes.Buffer), nil)
+	tu.ExpectNotNil(t, w.End())
+	tu.ExpectNotNil(t, w.BeginList(-2))
+
+	// missing elements leave the list open
+	tu.RequireNil(t, w.BeginList(2))
+	w.WriteInt(1)
+	tu.ExpectNotNil(t, w.End())
+	tu.ExpectNotNil(t, w.EndList())
+	w.WriteInt(2)
+	tu.ExpectNil(t, w.End())
+
+	tu.RequireNil(t, w.BeginClosedMap())
+	w.WriteString("key")
+	tu.ExpectNotNil(t, w.End())
+	w.WriteString("value")
+	tu.ExpectNil(t, w.End())
+
+	w.BeginClosedList()
+	tu.ExpectNotNil(t, w.End())
+	tu.ExpectNil(t, w.EndList())
+	tu.ExpectNil(t, w.Error())
+
+	// too many elements make writing fail
+	tu.RequireNil(t, w.BeginStruct("point", 1))
+	tu.ExpectNil(t, w.WriteInt(1))
+	tu.ExpectNotNil(t, w.WriteInt(2))
+	tu.ExpectNotNil(t, w.Error())
+
+	w = NewWriter(new(bytes.Buffer), nil, WithCanonical())
+	tu.ExpectEqual(t, w.BeginMap(1), errCanonicalStream)
+	tu.ExpectNil(t, w.BeginList(0))
+	tu.ExpectNil(t, w.End())
+}
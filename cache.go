@@ -0,0 +1,187 @@
+package fressian
+
+import (
+	"hash/fnv"
+	"math"
+	"reflect"
+)
+
+// writeCache assigns indices to the values in a writer's priority or
+// struct cache.
+//
+// Like the caches of the Java writer it compares values by equality,
+// not identity, so that e.g. two equal lists share a cache entry.
+// Values that can't be used as map keys (slices, maps, ...) are
+// hashed structurally and compared using reflect.DeepEqual.
+type writeCache struct {
+	simple  map[interface{}]int
+	hashed  map[uint64][]int
+	entries []interface{}
+	// the hash each entry was added with, because a value may change
+	// after it was cached
+	hashes []uint64
+}
+
+func newWriteCache() *writeCache {
+	return &writeCache{
+		make(map[interface{}]int, 16),
+		make(map[uint64][]int),
+		make([]interface{}, 0, 16),
+		make([]uint64, 0, 16),
+	}
+}
+
+// index returns the index of val in the cache, if it has one.
+func (c *writeCache) index(val interface{}) (int, bool) {
+	if isSimpleKey(val) {
+		idx, ok := c.simple[val]
+		return idx, ok
+	}
+
+	for _, idx := range c.hashed[hashValue(val)] {
+		if reflect.DeepEqual(c.entries[idx], val) {
+			return idx, true
+		}
+	}
+	return 0, false
+}
+
+// add adds val to the cache and returns its index.  If val was in the
+// cache already, index keeps returning the old index.
+func (c *writeCache) add(val interface{}) int {
+	idx := len(c.entries)
+	c.entries = append(c.entries, val)
+	var h uint64
+	if isSimpleKey(val) {
+		if _, ok := c.simple[val]; !ok {
+			c.simple[val] = idx
+		}
+	} else {
+		h = hashValue(val)
+		c.hashed[h] = append(c.hashed[h], idx)
+	}
+	c.hashes = append(c.hashes, h)
+	return idx
+}
+
+// reserve adds an entry that is only referred to by its index, and
+// returns that index.
+func (c *writeCache) reserve() int {
+	c.entries = append(c.entries, nil)
+	c.hashes = append(c.hashes, 0)
+	return len(c.entries) - 1
+}
+
+// truncate removes the entries added after the cache had n entries.
+func (c *writeCache) truncate(n int) {
+	for idx := n; idx < len(c.entries); idx++ {
+		val := c.entries[idx]
+		if val == nil {
+			continue
+		} else if isSimpleKey(val) {
+			if c.simple[val] == idx {
+				delete(c.simple, val)
+			}
+			continue
+		}
+
+		h := c.hashes[idx]
+		idxs := c.hashed[h]
+		for len(idxs) > 0 && idxs[len(idxs)-1] >= n {
+			idxs = idxs[:len(idxs)-1]
+		}
+		if len(idxs) == 0 {
+			delete(c.hashed, h)
+		} else {
+			c.hashed[h] = idxs
+		}
+	}
+	c.entries = c.entries[:n]
+	c.hashes = c.hashes[:n]
+}
+
+func (c *writeCache) len() int {
+	return len(c.entries)
+}
+
+// isSimpleKey reports whether val can be used as a map key directly.
+func isSimpleKey(val interface{}) bool {
+	switch val.(type) {
+	case bool, string, int, int8, int16, int32, int64,
+		uint, uint8, uint16, uint32, uint64, uintptr,
+		float32, float64, Keyword, Symbol, UUID:
+		return true
+	default:
+		return false
+	}
+}
+
+// hashValue computes a hash of val that is consistent with
+// reflect.DeepEqual.
+func hashValue(val interface{}) uint64 {
+	return hashReflect(reflect.ValueOf(val), 0)
+}
+
+func hashReflect(v reflect.Value, depth int) uint64 {
+	h := fnv.New64a()
+	var buf [8]byte
+	writeUint := func(u uint64) {
+		for i := range buf {
+			buf[i] = byte(u >> (8 * uint(i)))
+		}
+		h.Write(buf[:])
+	}
+
+	if !v.IsValid() {
+		return h.Sum64()
+	}
+
+	h.Write([]byte(v.Type().String()))
+	// deeper structures are only compared, which also stops cyclic
+	// values from being hashed forever
+	if depth > 8 {
+		return h.Sum64()
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			writeUint(1)
+		} else {
+			writeUint(0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		writeUint(uint64(v.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		writeUint(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		writeUint(math.Float64bits(v.Float()))
+	case reflect.Complex64, reflect.Complex128:
+		writeUint(math.Float64bits(real(v.Complex())))
+		writeUint(math.Float64bits(imag(v.Complex())))
+	case reflect.String:
+		h.Write([]byte(v.String()))
+	case reflect.Slice, reflect.Array:
+		writeUint(uint64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			writeUint(hashReflect(v.Index(i), depth+1))
+		}
+	case reflect.Map:
+		// entries are combined so that their order doesn't matter
+		var sum uint64
+		iter := v.MapRange()
+		for iter.Next() {
+			sum += hashReflect(iter.Key(), depth+1)*31 ^ hashReflect(iter.Value(), depth+1)
+		}
+		writeUint(uint64(v.Len()))
+		writeUint(sum)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			writeUint(hashReflect(v.Field(i), depth+1))
+		}
+	case reflect.Ptr, reflect.Interface:
+		writeUint(hashReflect(v.Elem(), depth+1))
+	}
+
+	return h.Sum64()
+}
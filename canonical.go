@@ -0,0 +1,92 @@
+package fressian
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math"
+	"reflect"
+	"sort"
+)
+
+// mapEntry is an entry of a map, with the canonical encoding of its
+// key.
+type mapEntry struct {
+	key, val reflect.Value
+	encoded  []byte
+}
+
+// sortedEntries returns the entries of m, sorted by the canonical
+// encoding of their keys.
+func (w *Writer) sortedEntries(m reflect.Value) []mapEntry {
+	entries := make([]mapEntry, 0, m.Len())
+	iter := m.MapRange()
+	for iter.Next() {
+		key := iter.Key()
+		entries = append(entries, mapEntry{key, iter.Value(), w.encodeCanonical(key.Interface())})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].encoded, entries[j].encoded) < 0
+	})
+	return entries
+}
+
+// encodeCanonical returns the canonical encoding of val.  If val can't
+// be written, writing it in the map will fail, so the error is
+// ignored here.
+func (w *Writer) encodeCanonical(val interface{}) []byte {
+	buf := new(bytes.Buffer)
+	kw := newWriterWith(buf, w.handlers, []Option{WithCanonical(), WithTimeRounding(w.timeRounding)})
+	kw.java = w.java
+	kw.WriteValue(val)
+	kw.Flush()
+	return buf.Bytes()
+}
+
+// canonicalFloat32 returns f, or the float32 all NaNs and zeros are
+// written as.
+func canonicalFloat32(f float32) float32 {
+	if f != f {
+		// like Java's Float.floatToIntBits
+		return math.Float32frombits(0x7fc00000)
+	} else if f == 0 {
+		return 0
+	}
+	return f
+}
+
+// canonicalFloat64 returns f, or the float64 all NaNs are written as.
+// Both zeros are written as DOUBLE_0 anyway.
+func canonicalFloat64(f float64) float64 {
+	if math.IsNaN(f) {
+		// like Java's Double.doubleToLongBits
+		return math.Float64frombits(0x7ff8000000000000)
+	}
+	return f
+}
+
+// Digest returns the SHA-256 hash of val, written using WithCanonical.
+// Equal values have the same digest, no matter the order of the
+// entries of their maps.  It panics if val can't be written, use
+// DigestWith to get an error instead.
+func Digest(val interface{}) [32]byte {
+	sum, err := DigestWith(nil, val)
+	if err != nil {
+		panic(err)
+	}
+	return sum
+}
+
+// DigestWith is like Digest, but writes val using handlers.
+func DigestWith(handlers *WriteHandlers, val interface{}) ([32]byte, error) {
+	var sum [32]byte
+	h := sha256.New()
+	w := newWriterWith(h, handlers, []Option{WithCanonical()})
+	if err := w.WriteValue(val); err != nil {
+		return sum, err
+	}
+	if err := w.Flush(); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
@@ -0,0 +1,87 @@
+package fressian
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	tu "github.com/klingtnet/gol/util/testing"
+)
+
+func writeCanonical(t *testing.T, vals ...interface{}) []byte {
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf, nil, WithCanonical())
+	for _, val := range vals {
+		tu.RequireNil(t, w.WriteValue(val))
+	}
+	tu.RequireNil(t, w.Flush())
+	return buf.Bytes()
+}
+
+func TestWriteCanonical(t *testing.T) {
+	m := map[interface{}]interface{}{"b": 2, "a": 1, 10: "ten"}
+	encoded := []byte{MAP, LIST_PACKED_LENGTH_START + 6,
+		10, STRING_PACKED_LENGTH_START + 3, 't', 'e', 'n',
+		STRING_PACKED_LENGTH_START + 1, 'a', 1,
+		STRING_PACKED_LENGTH_START + 1, 'b', 2}
+	for i := 0; i < 10; i++ {
+		bs := writeCanonical(t, m)
+		if !bytes.Equal(bs, encoded) {
+			t.Fatalf("expected % x, but got % x", encoded, bs)
+		}
+	}
+	readValueMap(t, encoded, m)
+
+	set := Set{"b": {}, "a": {}, 10: {}}
+	encoded = []byte{SET, LIST_PACKED_LENGTH_START + 3,
+		10, STRING_PACKED_LENGTH_START + 1, 'a', STRING_PACKED_LENGTH_START + 1, 'b'}
+	for i := 0; i < 10; i++ {
+		bs := writeCanonical(t, set)
+		if !bytes.Equal(bs, encoded) {
+			t.Fatalf("expected % x, but got % x", encoded, bs)
+		}
+	}
+
+	// nothing is cached, struct types are defined every time
+	point := StructAny{"point", []interface{}{1, 2}}
+	kw := Keyword{"ns", "name"}
+	bs := writeCanonical(t, point, kw, point, kw)
+	half := len(bs) / 2
+	tu.ExpectEqual(t, bs[0], byte(STRUCTTYPE))
+	if !bytes.Equal(bs[:half], writeCanonical(t, point, kw)) || !bytes.Equal(bs[:half], bs[half:]) {
+		t.Errorf("expected repeated values to be written the same, but got % x", bs)
+	}
+	r := newReader(bs)
+	for i := 0; i < 4; i++ {
+		r.readValue()
+	}
+	tu.ExpectNil(t, r.err())
+
+	// NaNs and zeros
+	nans := writeCanonical(t, math.Float64frombits(0x7ff8000000000001), float32(math.Inf(1)-math.Inf(1)))
+	tu.ExpectEqual(t, string(nans), string(writeCanonical(t, math.NaN(), float32(math.NaN()))))
+	negZero := float32(math.Copysign(0, -1))
+	tu.ExpectEqual(t, string(writeCanonical(t, negZero)), string(writeCanonical(t, float32(0))))
+}
+
+func TestDigest(t *testing.T) {
+	a := map[string]interface{}{}
+	b := map[string]interface{}{}
+	for i := 0; i < 100; i++ {
+		k := string(rune('a'+i%26)) + string(rune('a'+i/26))
+		a[k] = map[int]interface{}{i: []interface{}{k, i}}
+	}
+	for i := 99; i >= 0; i-- {
+		k := string(rune('a'+i%26)) + string(rune('a'+i/26))
+		b[k] = map[int]interface{}{i: []interface{}{k, i}}
+	}
+	tu.ExpectEqual(t, Digest(a), Digest(b))
+
+	b["aa"] = 1
+	if Digest(a) == Digest(b) {
+		t.Error("expected different values to have different digests")
+	}
+
+	_, err := DigestWith(nil, map[string]interface{}{"ch": make(chan int)})
+	tu.ExpectEqual(t, IsConversionError(err), true)
+}
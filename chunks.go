@@ -0,0 +1,277 @@
+package fressian
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+var (
+	errWriteAfterClose  = errors.New("write after Close")
+	errBytesWriterOpen  = errors.New("write while a BytesWriter is open")
+	errStringWriterOpen = errors.New("write while a StringWriter is open")
+)
+
+// bytesWriter writes a byte array in chunks, as the bytes are written
+// to it.
+type bytesWriter struct {
+	w       *Writer
+	buf     []byte
+	chunked bool
+	closed  bool
+}
+
+// BytesWriter starts writing a byte array whose bytes are written to
+// the returned io.WriteCloser, and that ends when it is closed.  The
+// bytes are written in chunks of BYTE_CHUNK_SIZE bytes as they arrive,
+// the same way WriteBytes writes them.  Nothing else may be written
+// before it is closed, writing anything else makes the Writer fail.
+func (w *Writer) BytesWriter() io.WriteCloser {
+	return w.newBytesWriter()
+}
+
+func (w *Writer) newBytesWriter() *bytesWriter {
+	w.beginValue()
+	bw := &bytesWriter{w: w}
+	w.chunks = bw
+	return bw
+}
+
+func (bw *bytesWriter) Write(p []byte) (int, error) {
+	if bw.closed {
+		return 0, errWriteAfterClose
+	}
+
+	n := 0
+	for len(p) > 0 {
+		if len(bw.buf) == BYTE_CHUNK_SIZE {
+			// only written once there are more bytes, so that the
+			// last chunk is written as BYTES
+			bw.w.writeCode(BYTES_CHUNK)
+			bw.w.writeCount(BYTE_CHUNK_SIZE)
+			bw.w.raw.writeRawBytes(bw.buf, 0, BYTE_CHUNK_SIZE)
+			bw.buf = bw.buf[:0]
+			bw.chunked = true
+		}
+		if err := bw.w.raw.err; err != nil {
+			return n, err
+		}
+
+		k := BYTE_CHUNK_SIZE - len(bw.buf)
+		if k > len(p) {
+			k = len(p)
+		}
+		bw.buf = append(bw.buf, p[:k]...)
+		p = p[k:]
+		n += k
+	}
+	return n, nil
+}
+
+// Close writes the remaining bytes and ends the byte array.
+func (bw *bytesWriter) Close() error {
+	if bw.closed {
+		return errWriteAfterClose
+	}
+	bw.closed = true
+	bw.w.chunks = nil
+	defer bw.w.endValue()
+
+	if !bw.chunked && len(bw.buf) < BYTES_PACKED_MAX_SIZE {
+		bw.w.raw.writeRawByte(byte(BYTES_PACKED_LENGTH_START + len(bw.buf)))
+	} else {
+		bw.w.writeCode(BYTES)
+		bw.w.writeCount(len(bw.buf))
+	}
+	return bw.w.raw.writeRawBytes(bw.buf, 0, len(bw.buf))
+}
+
+// discardChunks closes the open BytesWriter or StringWriter, if any,
+// without writing the rest of its value.
+func (w *Writer) discardChunks() {
+	switch cw := w.chunks.(type) {
+	case *bytesWriter:
+		cw.closed = true
+	case *stringWriter:
+		cw.closed = true
+	}
+	w.chunks = nil
+}
+
+// WriteBytesFrom writes the bytes read from r until io.EOF as a byte
+// array, without reading all of them into memory first.  If reading
+// from r fails, the byte array is incomplete and writing fails.
+func (w *Writer) WriteBytesFrom(r io.Reader) error {
+	bw := w.newBytesWriter()
+	if _, err := io.Copy(bw, r); err != nil {
+		w.fail(err)
+	}
+	return bw.Close()
+}
+
+// stringWriter writes a string in chunks, as the UTF-8 encoded bytes
+// of it are written to it.
+type stringWriter struct {
+	w       *Writer
+	buf     []byte
+	n       int
+	pending []byte
+	closed  bool
+}
+
+// StringWriter starts writing a string whose UTF-8 encoded bytes are
+// written to the returned io.WriteCloser, and that ends when it is
+// closed.  The string is written in chunks as it arrives, the same way
+// WriteString writes it.  Nothing else may be written before it is
+// closed, writing anything else makes the Writer fail.
+func (w *Writer) StringWriter() io.WriteCloser {
+	w.beginValue()
+	sw := &stringWriter{w: w, buf: make([]byte, STRING_CHUNK_MAX_SIZE)}
+	w.chunks = sw
+	return sw
+}
+
+func (sw *stringWriter) Write(p []byte) (int, error) {
+	if sw.closed {
+		return 0, errWriteAfterClose
+	}
+
+	sw.pending = append(sw.pending, p...)
+	// a rune may be split between writes, so an incomplete one at the
+	// end waits for the next write
+	end := 0
+	for end < len(sw.pending) && utf8.FullRune(sw.pending[end:]) {
+		_, size := utf8.DecodeRune(sw.pending[end:])
+		end += size
+	}
+	sw.writeChars(utf16.Encode([]rune(string(sw.pending[:end]))))
+	sw.pending = append(sw.pending[:0], sw.pending[end:]...)
+
+	if err := sw.w.raw.err; err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeChars puts chars into the buffer, writing it as a chunk each
+// time it is full.
+func (sw *stringWriter) writeChars(chars []uint16) {
+	pos := 0
+	for {
+		stringPos, bufPos := encodeToBuffer(chars, pos, sw.buf[sw.n:])
+		sw.n += bufPos
+		pos = stringPos
+		if pos >= len(chars) {
+			return
+		}
+
+		sw.w.writeCode(STRING_CHUNK)
+		sw.w.writeCount(sw.n)
+		sw.w.raw.writeRawBytes(sw.buf, 0, sw.n)
+		sw.n = 0
+	}
+}
+
+// Close writes the rest of the string and ends it.  Incomplete UTF-8
+// sequences at its end are written as U+FFFD, like WriteString does.
+func (sw *stringWriter) Close() error {
+	if sw.closed {
+		return errWriteAfterClose
+	}
+	sw.closed = true
+	sw.w.chunks = nil
+	defer sw.w.endValue()
+
+	sw.writeChars(utf16.Encode([]rune(string(sw.pending))))
+	if sw.n < STRING_PACKED_MAX_SIZE {
+		sw.w.raw.writeRawByte(STRING_PACKED_LENGTH_START + byte(sw.n))
+	} else {
+		sw.w.writeCode(STRING)
+		sw.w.writeCount(sw.n)
+	}
+	return sw.w.raw.writeRawBytes(sw.buf, 0, sw.n)
+}
+
+// bytesReader reads the chunks of a byte array.
+type bytesReader struct {
+	r         *Reader
+	remaining int
+	last      bool
+}
+
+// ReadBytes reads the next value, which must be a byte array or nil,
+// and returns a reader for its bytes, which are read from the
+// underlying reader as they are needed.  For nil it returns a nil
+// io.Reader.
+//
+// The bytes that are not read from it are skipped when the next value
+// is read.
+func (r *Reader) ReadBytes() (io.Reader, error) {
+	r.skipBytes()
+	code := r.readNextCode()
+	if err := r.err(); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case code >= BYTES_PACKED_LENGTH_START && code < BYTES_PACKED_LENGTH_START+BYTES_PACKED_MAX_SIZE:
+		r.bytes = &bytesReader{r, int(code - BYTES_PACKED_LENGTH_START), true}
+	case code == BYTES:
+		r.bytes = &bytesReader{r, r.readCount(), true}
+	case code == BYTES_CHUNK:
+		r.bytes = &bytesReader{r, r.readCount(), false}
+	default:
+		// e.g. a cached byte array
+		switch val := r.read(code).(type) {
+		case nil:
+			return nil, r.err()
+		case []byte:
+			return bytes.NewReader(val), r.err()
+		default:
+			return nil, fmt.Errorf("expected bytes, but got %T", val)
+		}
+	}
+	return r.bytes, r.err()
+}
+
+// skipBytes skips the rest of the byte array returned by ReadBytes.
+func (r *Reader) skipBytes() {
+	if r.bytes != nil {
+		io.Copy(io.Discard, r.bytes)
+		r.bytes = nil
+	}
+}
+
+func (br *bytesReader) Read(p []byte) (int, error) {
+	r := br.r
+	for br.remaining == 0 {
+		if br.last {
+			return 0, io.EOF
+		}
+
+		switch code := r.readNextCode(); code {
+		case BYTES_CHUNK:
+			br.remaining = r.readCount()
+		case BYTES:
+			br.remaining = r.readCount()
+			br.last = true
+		default:
+			if r.err() == nil {
+				r.raw.err = errors.New("invalid byte chunk")
+			}
+		}
+		if err := r.err(); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(p) > br.remaining {
+		p = p[:br.remaining]
+	}
+	n, err := r.raw.readRawBytes(p)
+	br.remaining -= n
+	return n, err
+}
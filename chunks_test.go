@@ -0,0 +1,204 @@
+package fressian
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	tu "github.com/klingtnet/gol/util/testing"
+)
+
+// writeInPieces writes p to w in pieces of n bytes.
+func writeInPieces(t *testing.T, w io.WriteCloser, p []byte, n int) {
+	for len(p) > 0 {
+		k := n
+		if k > len(p) {
+			k = len(p)
+		}
+		_, err := w.Write(p[:k])
+		tu.RequireNil(t, err)
+		p = p[k:]
+	}
+	tu.RequireNil(t, w.Close())
+}
+
+func TestBytesWriter(t *testing.T) {
+	for _, size := range []int{0, 5, 8, BYTE_CHUNK_SIZE, BYTE_CHUNK_SIZE + 1, 200000} {
+		bs := make([]byte, size)
+		for i := range bs {
+			bs[i] = byte(i)
+		}
+
+		expected := new(bytes.Buffer)
+		w := NewWriter(expected, nil)
+		w.WriteBytes(bs)
+		w.Flush()
+
+		buf := new(bytes.Buffer)
+		w = NewWriter(buf, nil)
+		writeInPieces(t, w.BytesWriter(), bs, 1000)
+		tu.RequireNil(t, w.Flush())
+		if !bytes.Equal(buf.Bytes(), expected.Bytes()) {
+			t.Errorf("%d bytes written differently than by WriteBytes", size)
+		}
+
+		buf = new(bytes.Buffer)
+		w = NewWriter(buf, nil)
+		tu.RequireNil(t, w.WriteBytesFrom(bytes.NewReader(bs)))
+		tu.RequireNil(t, w.Flush())
+		tu.ExpectEqual(t, bytes.Equal(buf.Bytes(), expected.Bytes()), true)
+	}
+
+	w := NewWriter(new(bytes.Buffer), nil)
+	failing := io.MultiReader(strings.NewReader("hello"), &failingReader{})
+	tu.ExpectEqual(t, w.WriteBytesFrom(failing), errRead)
+	tu.ExpectEqual(t, w.WriteValue(1), errRead)
+
+	bw := NewWriter(new(bytes.Buffer), nil).BytesWriter()
+	tu.RequireNil(t, bw.Close())
+	_, err := bw.Write([]byte("hi"))
+	tu.ExpectEqual(t, err, errWriteAfterClose)
+}
+
+var errRead = errors.New("read failed")
+
+type failingReader struct{}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	return 0, errRead
+}
+
+func TestStringWriter(t *testing.T) {
+	long := strings.Repeat("a", STRING_CHUNK_MAX_SIZE-1) + "😀" + strings.Repeat("日本語", 30000)
+	for _, s := range []string{"", "hi", "hällo, 日本語 😀", long} {
+		expected := new(bytes.Buffer)
+		w := NewWriter(expected, nil)
+		w.WriteString(s)
+		w.Flush()
+
+		// runes are split between writes
+		for _, n := range []int{1, 7, 4096} {
+			buf := new(bytes.Buffer)
+			w := NewWriter(buf, nil)
+			writeInPieces(t, w.StringWriter(), []byte(s), n)
+			tu.RequireNil(t, w.Flush())
+			if !bytes.Equal(buf.Bytes(), expected.Bytes()) {
+				t.Errorf("string of %d bytes written in pieces of %d differently than by WriteString", len(s), n)
+			}
+		}
+	}
+
+	// incomplete runes at the end are replaced
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf, nil)
+	writeInPieces(t, w.StringWriter(), []byte("a\xe6\x97"), 1)
+	w.Flush()
+	tu.ExpectEqual(t, readValue(t, buf.Bytes()), "a��")
+}
+
+func TestReadBytes(t *testing.T) {
+	large := make([]byte, 3*BYTE_CHUNK_SIZE+17)
+	for i := range large {
+		large[i] = byte(i * 7)
+	}
+
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf, nil)
+	w.WriteBytes(large)
+	w.WriteBytes([]byte("small"))
+	w.WriteBytes(large)
+	w.WriteNil()
+	w.WriteValue("done")
+	w.WriteInt(3)
+	w.Flush()
+
+	r := NewReader(buf, nil)
+	br, err := r.ReadBytes()
+	tu.RequireNil(t, err)
+	bs, err := io.ReadAll(br)
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, bytes.Equal(bs, large), true)
+
+	br, err = r.ReadBytes()
+	tu.RequireNil(t, err)
+	bs, err = io.ReadAll(br)
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, string(bs), "small")
+
+	// the rest of it is skipped
+	br, err = r.ReadBytes()
+	tu.RequireNil(t, err)
+	_, err = io.ReadFull(br, make([]byte, BYTE_CHUNK_SIZE+10))
+	tu.RequireNil(t, err)
+
+	br, err = r.ReadBytes()
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, br, nil)
+
+	val, err := r.ReadValue()
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, val, "done")
+
+	_, err = r.ReadBytes()
+	tu.ExpectNotNil(t, err)
+
+	// negative counts are rejected
+	_, err = newReader([]byte{BYTES, INT_PACKED_1_START}).ReadBytes()
+	tu.ExpectNotNil(t, err)
+	br, err = newReader([]byte{BYTES_CHUNK, 0x01, 0xaa, BYTES, INT_PACKED_1_START}).ReadBytes()
+	tu.RequireNil(t, err)
+	_, err = io.ReadAll(br)
+	tu.ExpectNotNil(t, err)
+}
+
+func TestChunkWriterOpen(t *testing.T) {
+	writes := []func(w *Writer) error{
+		func(w *Writer) error { return w.WriteValue("hello") },
+		func(w *Writer) error { return w.WriteValue(Keyword{"ns", "name"}) },
+		func(w *Writer) error { return w.WriteExt("point", 1, 2) },
+		func(w *Writer) error { return w.ResetCaches() },
+		func(w *Writer) error { return w.WriteFooter() },
+		func(w *Writer) error { return w.Close() },
+	}
+	for i, write := range writes {
+		buf := new(bytes.Buffer)
+		w := NewWriter(buf, nil, WithAutoCache(AutoCache{Keywords: true}))
+		bw := w.BytesWriter()
+		_, err := bw.Write([]byte("hi"))
+		tu.RequireNil(t, err)
+		err = write(w)
+		tu.ExpectEqual(t, err, errBytesWriterOpen)
+		w.raw.bw.Flush()
+		if buf.Len() != 0 {
+			t.Errorf("%d: expected nothing to be written, but got % x", i, buf.Bytes())
+		}
+	}
+
+	w := NewWriter(new(bytes.Buffer), nil)
+	sw := w.StringWriter()
+	tu.ExpectEqual(t, w.WriteInt(1), errStringWriterOpen)
+	tu.ExpectNotNil(t, sw.Close())
+}
+
+func TestChunkWriterRollback(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf, nil)
+	var sw io.WriteCloser
+	err := w.writeRecord(func() error {
+		sw = w.StringWriter()
+		sw.Write([]byte("partial"))
+		return errRead
+	})
+	tu.ExpectEqual(t, err, errRead)
+	_, err = sw.Write([]byte("more"))
+	tu.ExpectEqual(t, err, errWriteAfterClose)
+	tu.ExpectEqual(t, sw.Close(), errWriteAfterClose)
+
+	tu.ExpectNil(t, w.WriteRecord("complete"))
+	tu.ExpectNil(t, w.Close())
+	val, err := NewReader(buf, nil).ReadValue()
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, val, "complete")
+}
@@ -24,6 +24,8 @@ func prettySprint(value interface{}) string {
 		} else {
 			return fmt.Sprintf(":%s/%s", value.Namespace, value.Name)
 		}
+	case fressian.Symbol:
+		return value.String()
 	case fressian.UUID:
 		return value.String()
 	default:
@@ -56,7 +58,7 @@ func prettyPrint(indent string, value interface{}) {
 			}
 
 			switch val.(type) {
-			case bool, byte, int, float32, float64, string, fressian.Keyword, fressian.UUID:
+			case bool, byte, int, float32, float64, string, fressian.Keyword, fressian.Symbol, fressian.UUID:
 				fmt.Printf("%s%s %s\n", indent+"  ", prettySprint(key), prettySprint(val))
 			default:
 				prettyPrint(indent+"  ", key)
@@ -72,6 +74,13 @@ func prettyPrint(indent string, value interface{}) {
 		}
 		fmt.Printf("%s]\n", indent)
 
+	case fressian.ObjectArray:
+		fmt.Printf("%s#objects [\n", indent)
+		for _, val := range value {
+			prettyPrint(indent+"  ", val)
+		}
+		fmt.Printf("%s]\n", indent)
+
 	case []bool:
 		fmt.Printf("%s#booleans [", indent)
 		length := len(value)
@@ -94,7 +103,7 @@ func prettyPrint(indent string, value interface{}) {
 			}
 		}
 
-	case []int:
+	case []int32:
 		fmt.Printf("%s#ints [", indent)
 		length := len(value)
 		for i, val := range value {
@@ -105,6 +114,17 @@ func prettyPrint(indent string, value interface{}) {
 			}
 		}
 
+	case []int64:
+		fmt.Printf("%s#longs [", indent)
+		length := len(value)
+		for i, val := range value {
+			if i != length-1 {
+				fmt.Printf("%d, ", val)
+			} else {
+				fmt.Printf("%d]\n", val)
+			}
+		}
+
 	case []float32:
 		fmt.Printf("%s#floats [", indent)
 		length := len(value)
@@ -127,7 +147,7 @@ func prettyPrint(indent string, value interface{}) {
 			}
 		}
 
-	case fressian.Keyword, fressian.UUID:
+	case fressian.Keyword, fressian.Symbol, fressian.UUID:
 		fmt.Printf("%s%s\n", indent, prettySprint(value))
 
 	default:
@@ -148,16 +168,15 @@ func isGzipped(r *bufio.Reader) bool {
 }
 
 var pretty = flag.Bool("p", false, "pretty print the value read")
+var dictFile = flag.String("d", "", "dictionary the value was written with")
 
-func main() {
-	flag.Parse()
-
+func openFressian(path string) io.Reader {
 	var f io.Reader
-	if flag.NArg() == 0 {
+	if path == "" {
 		f = os.Stdin
 	} else {
 		var err error
-		f, err = os.Open(flag.Arg(0))
+		f, err = os.Open(path)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -172,7 +191,70 @@ func main() {
 		}
 	}
 
-	r := fressian.NewReader(f, nil)
+	return f
+}
+
+func readDictionary(path string) *fressian.Dictionary {
+	dict, err := fressian.ReadDictionary(openFressian(path))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return dict
+}
+
+// trainDict reads all values from the files given and writes the
+// dictionary that saves the most bytes for them.
+func trainDict(args []string) {
+	flags := flag.NewFlagSet("train-dict", flag.ExitOnError)
+	maxValues := flags.Int("n", fressian.PRIORITY_CACHE_MAX_SIZE, "maximum number of values")
+	maxStructs := flags.Int("s", fressian.STRUCT_CACHE_MAX_SIZE, "maximum number of struct types")
+	out := flags.String("o", "", "file to write the dictionary to (default stdout)")
+	flags.Parse(args)
+
+	trainer := fressian.NewDictionaryTrainer()
+	for _, path := range flags.Args() {
+		r := fressian.NewReader(openFressian(path), nil)
+		for {
+			obj, err := r.ReadValue()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				log.Fatal(err)
+			}
+			trainer.Add(obj)
+		}
+	}
+	dict := trainer.Dictionary(*maxValues, *maxStructs)
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	err := fressian.WriteDictionary(w, dict)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	if flag.Arg(0) == "train-dict" {
+		trainDict(flag.Args()[1:])
+		return
+	}
+
+	var opts []fressian.Option
+	if *dictFile != "" {
+		opts = append(opts, fressian.WithDictionary(readDictionary(*dictFile)))
+	}
+
+	r := fressian.NewReader(openFressian(flag.Arg(0)), nil, opts...)
 	obj, err := r.ReadValue()
 	if err != nil {
 		log.Fatal(err, obj)
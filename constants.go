@@ -77,10 +77,11 @@ const (
 )
 
 const (
-	BYTE_CHUNK_SIZE        = 65535
-	STRING_CHUNK_MAX_SIZE  = 65536
-	STRING_PACKED_MAX_SIZE = STRING_PACKED_LENGTH_END - STRING_PACKED_LENGTH_START
-	BYTES_PACKED_MAX_SIZE  = BYTES_PACKED_LENGTH_END - BYTES_PACKED_LENGTH_START
-	LIST_PACKED_MAX_SIZE   = LIST_PACKED_LENGTH_END - LIST_PACKED_LENGTH_START
-	STRUCT_CACHE_MAX_SIZE  = STRUCT_CACHE_PACKED_END - STRUCT_CACHE_PACKED_START
+	BYTE_CHUNK_SIZE         = 65535
+	STRING_CHUNK_MAX_SIZE   = 65536
+	STRING_PACKED_MAX_SIZE  = STRING_PACKED_LENGTH_END - STRING_PACKED_LENGTH_START
+	BYTES_PACKED_MAX_SIZE   = BYTES_PACKED_LENGTH_END - BYTES_PACKED_LENGTH_START
+	LIST_PACKED_MAX_SIZE    = LIST_PACKED_LENGTH_END - LIST_PACKED_LENGTH_START
+	STRUCT_CACHE_MAX_SIZE   = STRUCT_CACHE_PACKED_END - STRUCT_CACHE_PACKED_START
+	PRIORITY_CACHE_MAX_SIZE = PRIORITY_CACHE_PACKED_END - PRIORITY_CACHE_PACKED_START
 )
@@ -0,0 +1,236 @@
+package fressian
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Dictionary holds the entries that the caches of a Reader and a
+// Writer start out with, see WithDictionary.
+//
+// The writer only refers to Values when it caches a value, either
+// because of WriteAs or because of its AutoCache policy.  Structs are
+// used for every struct written with a tag in the dictionary, which
+// must always have the given number of fields.
+type Dictionary struct {
+	Values  []interface{}
+	Structs []StructType
+}
+
+var (
+	dictionaryValues  = Keyword{"", "values"}
+	dictionaryStructs = Keyword{"", "structs"}
+)
+
+// WriteDictionary writes d as a single fressian value, which
+// ReadDictionary can read back.
+func WriteDictionary(w io.Writer, d *Dictionary) error {
+	structs := make([]interface{}, len(d.Structs))
+	for i, st := range d.Structs {
+		structs[i] = []interface{}{st.Tag, st.Fields}
+	}
+
+	fw := NewWriter(w, nil)
+	err := fw.WriteValue(map[interface{}]interface{}{
+		dictionaryValues:  d.Values,
+		dictionaryStructs: structs,
+	})
+	if err != nil {
+		return err
+	}
+	return fw.Flush()
+}
+
+// ReadDictionary reads a dictionary written by WriteDictionary.
+func ReadDictionary(r io.Reader) (*Dictionary, error) {
+	obj, err := NewReader(r, nil).ReadValue()
+	if err != nil {
+		return nil, err
+	}
+
+	m, ok := obj.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid dictionary: %#v", obj)
+	}
+	values, ok := m[dictionaryValues].([]interface{})
+	if !ok && m[dictionaryValues] != nil {
+		return nil, fmt.Errorf("invalid dictionary values: %#v", m[dictionaryValues])
+	}
+	structs, ok := m[dictionaryStructs].([]interface{})
+	if !ok && m[dictionaryStructs] != nil {
+		return nil, fmt.Errorf("invalid dictionary structs: %#v", m[dictionaryStructs])
+	}
+
+	d := &Dictionary{Values: []interface{}{}, Structs: make([]StructType, len(structs))}
+	d.Values = append(d.Values, values...)
+	for i, obj := range structs {
+		st, ok := obj.([]interface{})
+		if !ok || len(st) != 2 {
+			return nil, fmt.Errorf("invalid dictionary struct: %#v", obj)
+		}
+		tag, ok := st[0].(string)
+		fields, ok2 := st[1].(int)
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("invalid dictionary struct: %#v", obj)
+		}
+		d.Structs[i] = StructType{tag, fields}
+	}
+	return d, nil
+}
+
+// DictionaryTrainer picks the dictionary that saves the most bytes for
+// a corpus of values.
+//
+// Each value added counts as a separate stream, so a dictionary entry
+// saves its definition once for every value it occurs in.
+type DictionaryTrainer struct {
+	values  map[string]*trainerStats
+	structs map[StructType]*trainerStats
+	n       int
+}
+
+type trainerStats struct {
+	streams     int
+	occurrences int
+	lastStream  int
+}
+
+func (s *trainerStats) add(stream int) {
+	s.occurrences++
+	if s.lastStream != stream {
+		s.streams++
+		s.lastStream = stream
+	}
+}
+
+// NewDictionaryTrainer creates a trainer without any values.
+func NewDictionaryTrainer() *DictionaryTrainer {
+	return &DictionaryTrainer{
+		make(map[string]*trainerStats),
+		make(map[StructType]*trainerStats),
+		0,
+	}
+}
+
+// Add counts the strings and struct types in val.
+func (t *DictionaryTrainer) Add(val interface{}) {
+	t.n++
+	t.add(val)
+}
+
+func (t *DictionaryTrainer) add(val interface{}) {
+	switch val := val.(type) {
+	case string:
+		t.addString(val)
+	case Keyword:
+		t.addString(val.Namespace)
+		t.addString(val.Name)
+	case Symbol:
+		t.addString(val.Namespace)
+		t.addString(val.Name)
+	case []interface{}:
+		for _, v := range val {
+			t.add(v)
+		}
+	case ObjectArray:
+		for _, v := range val {
+			t.add(v)
+		}
+	case map[interface{}]interface{}:
+		for k, v := range val {
+			t.add(k)
+			t.add(v)
+		}
+	case StructAny:
+		st := StructType{val.Tag, len(val.Values)}
+		stats, ok := t.structs[st]
+		if !ok {
+			stats = &trainerStats{}
+			t.structs[st] = stats
+		}
+		stats.add(t.n)
+		for _, v := range val.Values {
+			t.add(v)
+		}
+	}
+}
+
+func (t *DictionaryTrainer) addString(s string) {
+	if s == "" {
+		return
+	}
+
+	stats, ok := t.values[s]
+	if !ok {
+		stats = &trainerStats{}
+		t.values[s] = stats
+	}
+	stats.add(t.n)
+}
+
+// Dictionary returns a dictionary with at most maxValues values and
+// maxStructs struct types, chosen by the number of bytes they save.
+//
+// Values that never occur twice in the same stream are left out, as
+// they would not have been cached anyway.
+func (t *DictionaryTrainer) Dictionary(maxValues, maxStructs int) *Dictionary {
+	type candidate struct {
+		val    interface{}
+		profit int
+	}
+
+	values := make([]candidate, 0, len(t.values))
+	for s, stats := range t.values {
+		if stats.occurrences <= stats.streams {
+			continue
+		}
+		// a PUT_PRIORITY_CACHE and the string itself per stream
+		values = append(values, candidate{s, stats.streams * (1 + stringSize(s))})
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if values[i].profit != values[j].profit {
+			return values[i].profit > values[j].profit
+		}
+		return values[i].val.(string) < values[j].val.(string)
+	})
+
+	structs := make([]candidate, 0, len(t.structs))
+	for st, stats := range t.structs {
+		// STRUCTTYPE, the tag and the field count per stream
+		structs = append(structs, candidate{st, stats.streams * (2 + stringSize(st.Tag))})
+	}
+	sort.Slice(structs, func(i, j int) bool {
+		if structs[i].profit != structs[j].profit {
+			return structs[i].profit > structs[j].profit
+		}
+		a, b := structs[i].val.(StructType), structs[j].val.(StructType)
+		if a.Tag != b.Tag {
+			return a.Tag < b.Tag
+		}
+		return a.Fields < b.Fields
+	})
+
+	d := &Dictionary{Values: []interface{}{}, Structs: []StructType{}}
+	for _, c := range values {
+		if len(d.Values) >= maxValues {
+			break
+		}
+		d.Values = append(d.Values, c.val)
+	}
+	for _, c := range structs {
+		if len(d.Structs) >= maxStructs {
+			break
+		}
+		d.Structs = append(d.Structs, c.val.(StructType))
+	}
+	return d
+}
+
+// stringSize approximates the number of bytes s takes up when written.
+func stringSize(s string) int {
+	if len(s) < STRING_PACKED_MAX_SIZE {
+		return 1 + len(s)
+	}
+	return 3 + len(s)
+}
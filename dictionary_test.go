@@ -0,0 +1,110 @@
+package fressian
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	tu "github.com/klingtnet/gol/util/testing"
+)
+
+func TestDictionary(t *testing.T) {
+	dict := &Dictionary{
+		Values:  []interface{}{"event", "id"},
+		Structs: []StructType{{"point", 2}},
+	}
+
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf, nil, WithDictionary(dict), WithAutoCache(AutoCache{Keywords: true}))
+	w.WriteValue(Keyword{"event", "id"})
+	w.WriteExt("point", 1, 2)
+	w.ResetCaches()
+	w.WriteValue(Keyword{"event", "id"})
+	w.Flush()
+	tu.ExpectNil(t, w.Error())
+
+	bs := buf.Bytes()
+	tu.ExpectEqual(t, bytes.IndexByte(bs, PUT_PRIORITY_CACHE), -1)
+	tu.ExpectEqual(t, bytes.IndexByte(bs, STRUCTTYPE), -1)
+
+	r := NewReader(buf, nil, WithDictionary(dict))
+	expected := []interface{}{
+		Keyword{"event", "id"},
+		StructAny{"point", []interface{}{1, 2}},
+		Keyword{"event", "id"},
+	}
+	for _, val := range expected {
+		res, err := r.ReadValue()
+		tu.ExpectNil(t, err)
+		if !reflect.DeepEqual(val, res) {
+			t.Errorf("Expected reflect.DeepEqual(%#v, %#v)", val, res)
+		}
+	}
+}
+
+func TestDictionaryStructFields(t *testing.T) {
+	dict := &Dictionary{Structs: []StructType{{"point", 2}}}
+
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf, nil, WithDictionary(dict))
+	w.WriteExt("point", 1, 2, 3)
+	w.WriteExt("point", 4, 5)
+	w.BeginStruct("point", 3)
+	w.WriteInt(6)
+	w.WriteInt(7)
+	w.WriteInt(8)
+	w.End()
+	w.WriteExt("line", 1)
+	w.WriteExt("line", 1, 2)
+	w.Flush()
+	tu.ExpectNil(t, w.Error())
+
+	bs := buf.Bytes()
+	// the dictionary's point only fits the second struct
+	tu.ExpectEqual(t, bs[0], byte(STRUCTTYPE))
+	tu.ExpectEqual(t, bytes.IndexByte(bs, STRUCT_CACHE_PACKED_START), 11)
+
+	r := NewReader(buf, nil, WithDictionary(dict))
+	expected := []interface{}{
+		StructAny{"point", []interface{}{1, 2, 3}},
+		StructAny{"point", []interface{}{4, 5}},
+		StructAny{"point", []interface{}{6, 7, 8}},
+		StructAny{"line", []interface{}{1}},
+		StructAny{"line", []interface{}{1, 2}},
+	}
+	for _, val := range expected {
+		res, err := r.ReadValue()
+		tu.ExpectNil(t, err)
+		if !reflect.DeepEqual(val, res) {
+			t.Errorf("Expected reflect.DeepEqual(%#v, %#v)", val, res)
+		}
+	}
+}
+
+func TestDictionaryTrainer(t *testing.T) {
+	trainer := NewDictionaryTrainer()
+	for i := 0; i < 10; i++ {
+		trainer.Add([]interface{}{
+			map[interface{}]interface{}{Keyword{"event", "id"}: i, Keyword{"event", "type"}: "click"},
+			map[interface{}]interface{}{Keyword{"event", "id"}: i + 1, Keyword{"event", "type"}: "once"},
+			StructAny{"point", []interface{}{i, i}},
+			StructAny{"point", []interface{}{i, i, i}},
+		})
+	}
+	dict := trainer.Dictionary(1, 16)
+	if !reflect.DeepEqual(dict.Values, []interface{}{"event"}) {
+		t.Errorf("unexpected values %#v", dict.Values)
+	}
+	if !reflect.DeepEqual(dict.Structs, []StructType{{"point", 2}, {"point", 3}}) {
+		t.Errorf("unexpected structs %#v", dict.Structs)
+	}
+
+	buf := new(bytes.Buffer)
+	err := WriteDictionary(buf, dict)
+	tu.ExpectNil(t, err)
+	res, err := ReadDictionary(buf)
+	tu.ExpectNil(t, err)
+	if !reflect.DeepEqual(dict, res) {
+		t.Errorf("Expected reflect.DeepEqual(%#v, %#v)", dict, res)
+	}
+}
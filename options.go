@@ -0,0 +1,248 @@
+package fressian
+
+import "time"
+
+// Option configures a Reader or a Writer.  Options that only concern
+// one of them are ignored by the other.
+type Option func(*options)
+
+type options struct {
+	autoCache     *AutoCache
+	dictionary    *Dictionary
+	cacheLimit    cacheLimit
+	split         split
+	workers       int
+	unordered     bool
+	batchSize     int
+	flushInterval time.Duration
+	sharing       bool
+	int64s        bool
+	location      *time.Location
+	timeRounding  TimeRounding
+	java          bool
+	canonical     bool
+	footer        bool
+	readHandlers  *ReadHandlers
+	writeHandlers *WriteHandlers
+}
+
+type split struct {
+	records int
+	bytes   int64
+	footer  bool
+}
+
+func (s split) enabled() bool {
+	return s.records > 0 || s.bytes > 0
+}
+
+func (s split) full(records int, bytes int64) bool {
+	return (s.records > 0 && records >= s.records) || (s.bytes > 0 && bytes >= s.bytes)
+}
+
+type cacheLimit struct {
+	entries int
+	bytes   int
+}
+
+func (l cacheLimit) exceeded(entries, bytes int) bool {
+	return (l.entries > 0 && entries > l.entries) || (l.bytes > 0 && bytes > l.bytes)
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithAutoCache makes a Writer cache values according to ac, without
+// callers having to use WriteAs.  The number of cache entries is bounded
+// by ac.MaxEntries.
+func WithAutoCache(ac AutoCache) Option {
+	return func(o *options) {
+		o.autoCache = &ac
+	}
+}
+
+// WithDictionary starts the caches of a Reader or a Writer out with
+// the entries of d instead of empty.  RESET_CACHES returns them to
+// that state.  Both sides of a stream must use the same dictionary.
+func WithDictionary(d *Dictionary) Option {
+	return func(o *options) {
+		o.dictionary = d
+	}
+}
+
+// WithCacheLimit makes a Writer reset its caches before the next
+// top-level value once they hold more than entries values and struct
+// types, or more than bytes bytes of encoded values.  A limit of 0
+// means no limit.
+//
+// Values written inside a list started with BeginClosedList or
+// BeginOpenList count as top-level values.
+func WithCacheLimit(entries, bytes int) Option {
+	return func(o *options) {
+		o.cacheLimit = cacheLimit{entries, bytes}
+	}
+}
+
+// WithSplit makes a Writer split the elements of a list started with
+// BeginOpenList into segments of at most records elements, or of
+// roughly bytes bytes, if they are not 0.  Every segment but the first
+// starts with RESET_CACHES, preceded by a footer if footer is true, so
+// that it can be read without reading the segments before it.
+//
+// The offsets of the segments are available from Writer.Boundaries.
+// They are offsets into the uncompressed stream, also for a
+// GzipWriter.
+func WithSplit(records int, bytes int64, footer bool) Option {
+	return func(o *options) {
+		o.split = split{records, bytes, footer}
+	}
+}
+
+// WithWorkers sets the number of goroutines used by ReadParallel and
+// ParallelWriter.
+func WithWorkers(n int) Option {
+	return func(o *options) {
+		o.workers = n
+	}
+}
+
+// WithUnordered lets ReadParallel pass values to its callback as soon
+// as they are decoded, instead of in the order of the stream.
+func WithUnordered() Option {
+	return func(o *options) {
+		o.unordered = true
+	}
+}
+
+// WithBatchSize sets the number of values a ParallelWriter encodes
+// together, sharing their caches, or the number of values a SyncWriter
+// writes before it flushes.
+func WithBatchSize(n int) Option {
+	return func(o *options) {
+		o.batchSize = n
+	}
+}
+
+// WithFlushInterval makes a SyncWriter flush its output periodically.
+func WithFlushInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.flushInterval = d
+	}
+}
+
+// WithSharing makes a Writer write pointers, maps and slices that
+// occur more than once only once, and refer to them using the priority
+// cache afterwards.  A Reader then returns the same map or slice for
+// each occurrence.
+//
+// Values are only shared within a value passed to WriteValue or
+// WriteAs, and within a top-level value or element of an open list at
+// most: a value written again later is written in full.  The priority
+// cache entries of shared values are only freed when the caches are
+// reset, e.g. because of WithCacheLimit.
+func WithSharing() Option {
+	return func(o *options) {
+		o.sharing = true
+	}
+}
+
+// WithInt64 makes a Reader return integers as int64 instead of int,
+// which doesn't depend on the platform.
+func WithInt64() Option {
+	return func(o *options) {
+		o.int64s = true
+	}
+}
+
+// WithLocation sets the location of the times a Reader returns, which
+// is UTC by default.
+func WithLocation(loc *time.Location) Option {
+	return func(o *options) {
+		o.location = loc
+	}
+}
+
+// TimeRounding is how a Writer handles times with more than
+// millisecond precision, which fressian can't represent.
+type TimeRounding int
+
+const (
+	// TruncateTime drops the sub-millisecond part of times.
+	TruncateTime TimeRounding = iota
+	// RoundTime rounds times to the nearest millisecond, and
+	// halfway times up.
+	RoundTime
+	// RejectSubMillisecond makes writing such times fail.
+	RejectSubMillisecond
+)
+
+// WithTimeRounding sets how a Writer handles times with more than
+// millisecond precision.  The default is TruncateTime.
+func WithTimeRounding(rounding TimeRounding) Option {
+	return func(o *options) {
+		o.timeRounding = rounding
+	}
+}
+
+// WithJavaCompatible makes a Writer make the encoding choices of Java's
+// FressianWriter with the Clojure handlers, so that both can write the
+// same bytes for the same values, except for maps.  The namespaces and names of
+// keywords and symbols are cached, an empty namespace is written as
+// nil, and nothing else is cached or shared on its own.  Like in Java,
+// the caches are never reset on their own.  It overrides
+// WithAutoCache and WithSharing options before it.
+//
+// Maps with more than one entry are not compatible: their entries are
+// written in the random order of Go maps, not in the order Clojure
+// keeps them in, so their bytes differ from Java's and from one write
+// to the next.  Use WithCanonical to write values that are hashed.
+func WithJavaCompatible() Option {
+	return func(o *options) {
+		o.autoCache = &AutoCache{Keywords: true, Symbols: true, MaxEntries: -1}
+		o.sharing = false
+		o.java = true
+	}
+}
+
+// WithCanonical makes a Writer write equal values as the same bytes,
+// so that they can be hashed or signed, see Digest.  The entries of
+// maps are sorted by the bytes of their keys, nothing is cached or
+// shared, struct types are defined every time they are written, and
+// all NaNs are written the same, as are both float32 zeros.  It
+// overrides WithAutoCache and WithSharing options before it.
+func WithCanonical() Option {
+	return func(o *options) {
+		o.autoCache = nil
+		o.sharing = false
+		o.canonical = true
+	}
+}
+
+// WithFooter makes Writer.Close write a footer after ending the open
+// lists, so that readers can verify the end of the stream.
+func WithFooter() Option {
+	return func(o *options) {
+		o.footer = true
+	}
+}
+
+// WithReadHandlers makes a Reader use the registry h, which the
+// handlers passed to NewReader are added to.
+func WithReadHandlers(h *ReadHandlers) Option {
+	return func(o *options) {
+		o.readHandlers = h
+	}
+}
+
+// WithWriteHandlers makes a Writer use the registry h.  The handler
+// passed to NewWriter is used for values h has no handler for.
+func WithWriteHandlers(h *WriteHandlers) Option {
+	return func(o *options) {
+		o.writeHandlers = h
+	}
+}
@@ -0,0 +1,117 @@
+package fressian
+
+import (
+	"io"
+	"runtime"
+)
+
+// minSegmentSize is the minimum size of the segments ReadParallel
+// decodes, so that workers don't spend their time on tiny segments.
+var minSegmentSize int64 = 1 << 20
+
+type segmentResult struct {
+	vals []interface{}
+	err  error
+}
+
+type segmentJob struct {
+	span
+	result chan segmentResult
+}
+
+// ReadParallel decodes the values in the first size bytes of r using
+// several goroutines, and calls fn with each of them.  If the stream is
+// a list started with BEGIN_OPEN_LIST, fn is called with its elements.
+//
+// The stream is split at RESET_CACHES and footers, which WithSplit or
+// WithCacheLimit make a Writer emit, and each segment is decoded with
+// caches of its own.  Footers are checked against the bytes before
+// them, like Reader checks them.  The values are passed to fn in the
+// order they occur in, unless WithUnordered is given.  The number of
+// goroutines is set using WithWorkers, and defaults to GOMAXPROCS.
+//
+// ReadParallel stops at the first error, including errors returned by
+// fn, and returns it.
+func ReadParallel(r io.ReaderAt, size int64, handlers *ReadHandlers, fn func(val interface{}) error, opts ...Option) error {
+	o := newOptions(opts)
+	workers := o.workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	scanner := newScanner(io.NewSectionReader(r, 0, size), o.dictionary)
+	spans, err := scanner.scanSpans(minSegmentSize)
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	jobs := make(chan segmentJob)
+	ordered := make(chan chan segmentResult, workers)
+	unordered := make(chan segmentResult, workers)
+	go func() {
+		defer close(jobs)
+		defer close(ordered)
+		for _, sp := range spans {
+			job := segmentJob{sp, unordered}
+			if !o.unordered {
+				job.result = make(chan segmentResult, 1)
+			}
+			select {
+			case jobs <- job:
+			case <-stop:
+				return
+			}
+			if !o.unordered {
+				select {
+				case ordered <- job.result:
+				case <-stop:
+					return
+				}
+			}
+		}
+	}()
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range jobs {
+				rd := newReaderWith(io.NewSectionReader(r, job.start, job.end-job.start), handlers, opts)
+				vals, err := rd.readAll()
+				select {
+				case job.result <- segmentResult{vals, err}:
+				case <-stop:
+					return
+				}
+			}
+		}()
+	}
+
+	handle := func(res segmentResult) error {
+		if res.err != nil {
+			return res.err
+		}
+		for _, val := range res.vals {
+			if err := fn(val); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if o.unordered {
+		for range spans {
+			if err := handle(<-unordered); err != nil {
+				return err
+			}
+		}
+	} else {
+		for result := range ordered {
+			if err := handle(<-result); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
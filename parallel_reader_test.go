@@ -0,0 +1,113 @@
+package fressian
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	tu "github.com/klingtnet/gol/util/testing"
+)
+
+func TestReadParallel(t *testing.T) {
+	defer func(size int64) { minSegmentSize = size }(minSegmentSize)
+	minSegmentSize = 1
+
+	for _, openList := range []bool{false, true} {
+		buf := new(bytes.Buffer)
+		w := NewWriter(buf, nil, WithSplit(7, 0, true), WithAutoCache(AutoCache{Keywords: true}))
+		if openList {
+			w.BeginOpenList()
+		}
+		records := make([]interface{}, 100)
+		for i := range records {
+			if !openList && i > 0 && i%7 == 0 {
+				if i%14 == 0 {
+					w.WriteFooter()
+				} else {
+					w.ResetCaches()
+				}
+			}
+			records[i] = []interface{}{Keyword{"record", "id"}, i, StructAny{"point", []interface{}{i, i}}}
+			w.WriteValue(records[i])
+		}
+		if openList {
+			w.EndList()
+		}
+		w.Flush()
+		tu.RequireNil(t, w.Error())
+
+		bs := buf.Bytes()
+		spans, err := newScanner(bytes.NewReader(bs), nil).scanSpans(minSegmentSize)
+		tu.RequireNil(t, err)
+		tu.ExpectEqual(t, len(spans), 15)
+
+		var ordered []interface{}
+		err = ReadParallel(bytes.NewReader(bs), int64(len(bs)), nil, func(val interface{}) error {
+			ordered = append(ordered, val)
+			return nil
+		}, WithWorkers(4))
+		tu.ExpectNil(t, err)
+		if !reflect.DeepEqual(records, ordered) {
+			t.Errorf("Expected reflect.DeepEqual(%#v, %#v)", records, ordered)
+		}
+
+		var unordered []interface{}
+		err = ReadParallel(bytes.NewReader(bs), int64(len(bs)), nil, func(val interface{}) error {
+			unordered = append(unordered, val)
+			return nil
+		}, WithWorkers(4), WithUnordered())
+		tu.ExpectNil(t, err)
+		sort.Slice(unordered, func(i, j int) bool {
+			return unordered[i].([]interface{})[1].(int) < unordered[j].([]interface{})[1].(int)
+		})
+		if !reflect.DeepEqual(records, unordered) {
+			t.Errorf("Expected reflect.DeepEqual(%#v, %#v)", records, unordered)
+		}
+
+		stop := errors.New("stop")
+		n := 0
+		err = ReadParallel(bytes.NewReader(bs), int64(len(bs)), nil, func(val interface{}) error {
+			n++
+			if n == 10 {
+				return stop
+			}
+			return nil
+		}, WithWorkers(4))
+		tu.ExpectEqual(t, err, stop)
+		tu.ExpectEqual(t, n, 10)
+	}
+}
+
+func TestReadParallelFooters(t *testing.T) {
+	defer func(size int64) { minSegmentSize = size }(minSegmentSize)
+	minSegmentSize = 1
+
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf, nil, WithSplit(7, 0, true))
+	w.BeginOpenList()
+	for i := 0; i < 100; i++ {
+		w.WriteValue(fmt.Sprintf("record-%03d", i))
+	}
+	w.EndList()
+	w.Flush()
+	tu.RequireNil(t, w.Error())
+
+	bs := buf.Bytes()
+	read := func() error {
+		return ReadParallel(bytes.NewReader(bs), int64(len(bs)), nil, func(val interface{}) error {
+			return nil
+		}, WithWorkers(4))
+	}
+	tu.ExpectNil(t, read())
+
+	// the segment is still readable, but doesn't match its footer
+	bs[bytes.Index(bs, []byte("record-050"))] = 'R'
+	err := read()
+	if err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("expected a footer checksum error, but got %v", err)
+	}
+}
@@ -0,0 +1,214 @@
+package fressian
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// defaultBatchSize is the number of values per batch of a
+// ParallelWriter, unless WithBatchSize is given.
+const defaultBatchSize = 1024
+
+type batchResult struct {
+	bs  []byte
+	err error
+}
+
+type batchJob struct {
+	vals   []interface{}
+	reset  bool
+	result chan batchResult
+}
+
+// ParallelWriter encodes top-level values in batches, using several
+// goroutines.
+//
+// Every batch is encoded by a Writer of its own, starting with fresh
+// caches, and the batches are written in order, each but the first
+// preceded by RESET_CACHES.  The output can be read by an ordinary
+// Reader, or by ReadParallel.
+//
+// The number of goroutines is set using WithWorkers and defaults to
+// GOMAXPROCS, the size of the batches is set using WithBatchSize.  The
+// other options are passed on to the Writers of the batches, except for
+// WithSplit, WithCacheLimit and WithFooter, which are ignored: the
+// batches already start with empty caches.
+type ParallelWriter struct {
+	bw        *bufio.Writer
+	handlers  *WriteHandlers
+	opts      []Option
+	batchSize int
+	batch     []interface{}
+	batches   int
+
+	jobs    chan batchJob
+	results chan chan batchResult
+	pending sync.WaitGroup
+	done    chan struct{}
+
+	mu     sync.Mutex
+	err    error
+	closed bool
+}
+
+// NewParallelWriter creates a ParallelWriter writing to w.
+func NewParallelWriter(w io.Writer, handlers *WriteHandlers, opts ...Option) *ParallelWriter {
+	o := newOptions(opts)
+	workers := o.workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	batchSize := o.batchSize
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+
+	pw := &ParallelWriter{
+		bw:        bufio.NewWriter(w),
+		handlers:  handlers,
+		opts:      append(opts[:len(opts):len(opts)], withoutSegments),
+		batchSize: batchSize,
+		batch:     make([]interface{}, 0, batchSize),
+		jobs:      make(chan batchJob),
+		results:   make(chan chan batchResult, workers),
+		done:      make(chan struct{}),
+	}
+	for i := 0; i < workers; i++ {
+		go pw.encode()
+	}
+	go pw.splice()
+	return pw
+}
+
+// withoutSegments drops the options that split the output of a Writer,
+// which would split each batch on its own.
+func withoutSegments(o *options) {
+	o.split = split{}
+	o.cacheLimit = cacheLimit{}
+	o.footer = false
+}
+
+// encode encodes the batches it receives, until the writer is closed.
+func (pw *ParallelWriter) encode() {
+	for job := range pw.jobs {
+		buf := new(bytes.Buffer)
+		w := newWriterWith(buf, pw.handlers, pw.opts)
+		if job.reset {
+			w.ResetCaches()
+		}
+		var err error
+		for _, val := range job.vals {
+			if err = w.WriteValue(val); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			w.Flush()
+			err = w.Error()
+		}
+		job.result <- batchResult{buf.Bytes(), err}
+	}
+}
+
+// splice writes the encoded batches in order.  After an error the
+// remaining batches are discarded.
+func (pw *ParallelWriter) splice() {
+	defer close(pw.done)
+	for result := range pw.results {
+		res := <-result
+		if pw.Error() == nil {
+			err := res.err
+			if err == nil {
+				_, err = pw.bw.Write(res.bs)
+			}
+			pw.fail(err)
+		}
+		pw.pending.Done()
+	}
+}
+
+func (pw *ParallelWriter) fail(err error) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if pw.err == nil {
+		pw.err = err
+	}
+}
+
+// Error returns the first error that occurred while encoding or writing
+// the values.
+func (pw *ParallelWriter) Error() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	return pw.err
+}
+
+// dispatch hands the current batch to the encoding goroutines.
+func (pw *ParallelWriter) dispatch() {
+	if len(pw.batch) == 0 {
+		return
+	}
+
+	result := make(chan batchResult, 1)
+	pw.pending.Add(1)
+	pw.jobs <- batchJob{pw.batch, pw.batches > 0, result}
+	pw.results <- result
+	pw.batch = make([]interface{}, 0, pw.batchSize)
+	pw.batches++
+}
+
+// WriteValue adds val to the current batch, which is encoded once it
+// is full.  Values must not be modified after they have been written,
+// until Flush or Close return.
+//
+// Errors are reported by later calls of WriteValue, Flush or Close.
+func (pw *ParallelWriter) WriteValue(val interface{}) error {
+	if pw.closed {
+		return errWriteAfterClose
+	}
+	if err := pw.Error(); err != nil {
+		return err
+	}
+
+	pw.batch = append(pw.batch, val)
+	if len(pw.batch) >= pw.batchSize {
+		pw.dispatch()
+	}
+	return nil
+}
+
+// Flush encodes the values written so far, and waits until they have
+// been written to the underlying writer.
+func (pw *ParallelWriter) Flush() error {
+	if pw.closed {
+		return errWriteAfterClose
+	}
+	pw.dispatch()
+	pw.pending.Wait()
+	if err := pw.Error(); err != nil {
+		return err
+	}
+	if err := pw.bw.Flush(); err != nil {
+		pw.fail(err)
+		return err
+	}
+	return nil
+}
+
+// Close flushes the writer and stops its goroutines.  Writing
+// afterwards fails, and closing it again returns the first error that
+// occurred.
+func (pw *ParallelWriter) Close() error {
+	if pw.closed {
+		return pw.Error()
+	}
+	err := pw.Flush()
+	pw.closed = true
+	close(pw.jobs)
+	close(pw.results)
+	<-pw.done
+	return err
+}
@@ -0,0 +1,73 @@
+package fressian
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+
+	tu "github.com/klingtnet/gol/util/testing"
+)
+
+func TestParallelWriter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewParallelWriter(buf, nil, WithWorkers(4), WithBatchSize(10), WithAutoCache(AutoCache{Keywords: true}))
+	records := make([]interface{}, 95)
+	for i := range records {
+		records[i] = []interface{}{Keyword{"record", "id"}, i, StructAny{"point", []interface{}{i, i}}}
+		tu.RequireNil(t, w.WriteValue(records[i]))
+	}
+	tu.ExpectNil(t, w.Close())
+
+	// every batch can be read on its own
+	bs := buf.Bytes()
+	spans, err := newScanner(bytes.NewReader(bs), nil).scanSpans(1)
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, len(spans), 10)
+	for i, sp := range spans {
+		r := NewReader(bytes.NewReader(bs[sp.start:sp.end]), nil)
+		vals, err := r.readAll()
+		tu.RequireNil(t, err)
+		end := i*10 + 10
+		if end > len(records) {
+			end = len(records)
+		}
+		if !reflect.DeepEqual(vals, records[i*10:end]) {
+			t.Errorf("unexpected values in batch %d: %#v", i, vals)
+		}
+	}
+
+	r := NewReader(bytes.NewReader(bs), nil)
+	var res []interface{}
+	for {
+		val, err := r.ReadValue()
+		if err == io.EOF {
+			break
+		}
+		tu.RequireNil(t, err)
+		res = append(res, val)
+	}
+	if !reflect.DeepEqual(records, res) {
+		t.Errorf("Expected reflect.DeepEqual(%#v, %#v)", records, res)
+	}
+
+	tu.ExpectNil(t, w.Close())
+	tu.ExpectEqual(t, w.WriteValue(1), errWriteAfterClose)
+
+	w = NewParallelWriter(new(bytes.Buffer), nil, WithBatchSize(1))
+	w.WriteValue(make(chan int))
+	err = w.Close()
+	tu.ExpectEqual(t, IsConversionError(err), true)
+	tu.ExpectEqual(t, w.Close(), err)
+
+	// the batches are not split on their own
+	buf = new(bytes.Buffer)
+	w = NewParallelWriter(buf, nil, WithBatchSize(50), WithCacheLimit(1, 0), WithFooter())
+	for _, val := range records {
+		w.WriteValue(val)
+	}
+	tu.RequireNil(t, w.Close())
+	spans, err = newScanner(bytes.NewReader(buf.Bytes()), nil).scanSpans(1)
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, len(spans), 2)
+}
@@ -7,11 +7,18 @@ import (
 	"bytes"
 	"compress/gzip"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/adler32"
 	"io"
-	"log"
+	"math"
 	"math/big"
-	"net/url"
+	"reflect"
+	"strings"
 	"time"
+	"unicode/utf16"
+	"unicode/utf8"
 )
 
 // Tagged is a generic interface for tagged data.
@@ -38,69 +45,114 @@ func (k Keyword) String() string {
 	}
 }
 
-type structType struct {
-	tag    string
-	fields int
+// Symbol represents a fressian symbol, consisting of a namespace
+// (which may be empty) and a name.
+type Symbol struct {
+	Namespace string
+	Name      string
 }
 
+func (s Symbol) Key() string          { return "sym" }
+func (s Symbol) Value() []interface{} { return []interface{}{s.Namespace, s.Name} }
+
+func (s Symbol) String() string {
+	if s.Namespace == "" {
+		return s.Name
+	} else {
+		return s.Namespace + "/" + s.Name
+	}
+}
+
+// StructType is a struct tag together with the number of fields of
+// structs with that tag.
+type StructType struct {
+	Tag    string
+	Fields int
+}
+
+// ObjectArray is a fressian Object[], as opposed to an ordinary list.
+type ObjectArray []interface{}
+
+// Set is a fressian set.
+type Set map[interface{}]struct{}
+
 type StructAny struct {
 	Tag    string
 	Values []interface{}
 }
 
 type rawReader struct {
-	br    *bufio.Reader
-	count int
-	err   error
+	br       *bufio.Reader
+	count    int
+	checksum hash.Hash32
+	buf      [1]byte
+	err      error
 }
 
 func newRawReader(r io.Reader) *rawReader {
-	return &rawReader{bufio.NewReader(r), 0, nil}
+	return &rawReader{br: bufio.NewReader(r), checksum: adler32.New()}
 }
 
 func (r *rawReader) readRawByte() byte {
+	if r.err != nil {
+		return 0
+	}
 	res, err := r.br.ReadByte()
 	if err != nil {
 		r.err = err
 		return 0
 	}
 	r.count++
+	r.buf[0] = res
+	r.checksum.Write(r.buf[:])
 	return res
 }
 
-func (r *rawReader) readRawInt8() int {
-	return int(r.readRawByte())
+// readRawBytes reads len(p) bytes into p, unless reading fails.
+func (r *rawReader) readRawBytes(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := io.ReadFull(r.br, p)
+	r.count += n
+	r.checksum.Write(p[:n])
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
+
+func (r *rawReader) reset() {
+	r.count = 0
+	r.checksum.Reset()
 }
 
-func (r *rawReader) readRawInt16() int {
-	return (int(r.readRawByte()) << 8) + int(r.readRawByte())
+func (r *rawReader) readRawInt8() int64 {
+	return int64(r.readRawByte())
 }
 
-func (r *rawReader) readRawInt24() int {
-	return (int(r.readRawByte()) << 16) + (int(r.readRawByte()) << 8) + int(r.readRawByte())
+func (r *rawReader) readRawInt16() int64 {
+	return (r.readRawInt8() << 8) | r.readRawInt8()
 }
 
-func (r *rawReader) readRawInt32() int {
-	return (int(r.readRawByte()) << 24) + (int(r.readRawByte()) << 16) + (int(r.readRawByte()) << 8) + int(r.readRawByte())
+func (r *rawReader) readRawInt24() int64 {
+	return (r.readRawInt8() << 16) | r.readRawInt16()
 }
 
-func (r *rawReader) readRawInt40() int {
+func (r *rawReader) readRawInt32() int64 {
+	return (r.readRawInt8() << 24) | r.readRawInt24()
+}
+
+func (r *rawReader) readRawInt40() int64 {
 	return (r.readRawInt8() << 32) | r.readRawInt32()
 }
 
-func (r *rawReader) readRawInt48() int {
+func (r *rawReader) readRawInt48() int64 {
 	return (r.readRawInt16() << 32) | r.readRawInt32()
 }
 
-func (r *rawReader) readRawInt64() int {
-	return ((int(r.readRawByte()) & 0xff) << 56) |
-		((int(r.readRawByte()) & 0xff) << 48) |
-		((int(r.readRawByte()) & 0xff) << 40) |
-		((int(r.readRawByte()) & 0xff) << 32) |
-		((int(r.readRawByte()) & 0xff) << 24) |
-		((int(r.readRawByte()) & 0xff) << 16) |
-		((int(r.readRawByte()) & 0xff) << 8) |
-		(int(r.readRawByte()) & 0xff)
+func (r *rawReader) readRawInt64() int64 {
+	return (r.readRawInt32() << 32) | r.readRawInt32()
 }
 
 // ReadHandler is an alias for custom handlers of tagged data.
@@ -113,7 +165,11 @@ type Reader struct {
 	raw           *rawReader
 	priorityCache []interface{}
 	structCache   []interface{}
-	handlers      map[string]ReadHandler
+	handlers      *ReadHandlers
+	dictionary    *Dictionary
+	int64s        bool
+	location      *time.Location
+	bytes         *bytesReader
 }
 
 type markerObject struct{}
@@ -121,24 +177,63 @@ type markerObject struct{}
 var underConstruction = markerObject{}
 
 // NewReader creates a new Reader.
-func NewReader(r io.Reader, handlers map[string]ReadHandler) *Reader {
-	return &Reader{newRawReader(r), make([]interface{}, 0, 32), make([]interface{}, 0, 16), handlers}
+//
+// The handlers are used for the tags they are registered for, in
+// addition to the registry given using WithReadHandlers, or to the core
+// handlers.
+func NewReader(r io.Reader, handlers map[string]ReadHandler, opts ...Option) *Reader {
+	var registry *ReadHandlers
+	if len(handlers) > 0 {
+		registry = NewReadHandlers(newOptions(opts).readHandlers).AddMap(handlers)
+	}
+	return newReaderWith(r, registry, opts)
 }
 
-func NewGzipReader(r io.Reader, handlers map[string]ReadHandler) *Reader {
-	r, err := gzip.NewReader(r)
+// newReaderWith creates a Reader that uses handlers, or the registry
+// given using WithReadHandlers if handlers is nil.
+func newReaderWith(r io.Reader, handlers *ReadHandlers, opts []Option) *Reader {
+	o := newOptions(opts)
+	if handlers == nil {
+		handlers = o.readHandlers
+	}
+	if handlers == nil {
+		handlers = coreReadHandlers
+	}
+	loc := o.location
+	if loc == nil {
+		loc = time.UTC
+	}
+	rd := &Reader{newRawReader(r), nil, nil, handlers, o.dictionary, o.int64s, loc, nil}
+	rd.resetCaches()
+	return rd
+}
+
+func NewGzipReader(r io.Reader, handlers map[string]ReadHandler, opts ...Option) *Reader {
+	gr, err := gzip.NewReader(r)
 	if err != nil {
-		log.Fatal("NewGzipReader: ", err)
+		// reading from it fails with err
+		rd := NewReader(bytes.NewReader(nil), handlers, opts...)
+		rd.fail(fmt.Errorf("NewGzipReader: %w", err))
+		return rd
 	}
-	return NewReader(r, handlers)
+	return NewReader(gr, handlers, opts...)
 }
 
 func (r *Reader) err() error {
 	return r.raw.err
 }
 
+// fail makes err the error of the reader, unless reading failed
+// before.  Once reading failed, nothing is read anymore.
+func (r *Reader) fail(err error) {
+	if r.raw.err == nil {
+		r.raw.err = err
+	}
+}
+
 // ReadValue reads the next object from the Reader.
 func (r *Reader) ReadValue() (interface{}, error) {
+	r.skipBytes()
 	return r.readValue(), r.err()
 }
 
@@ -146,50 +241,61 @@ func (r *Reader) readNextCode() byte {
 	return r.raw.readRawByte()
 }
 
+// readInt reads an int used as a count or an index.
 func (r *Reader) readInt() int {
-	var result int
-
-	code := r.readNextCode()
-	switch code {
-	case 0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0A, 0x0B, 0x0C, 0x0D, 0x0E, 0x0F,
-		0x10, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18, 0x19, 0x1A, 0x1B, 0x1C, 0x1D, 0x1E, 0x1F,
-		0x20, 0x21, 0x22, 0x23, 0x24, 0x25, 0x26, 0x27, 0x28, 0x29, 0x2A, 0x2B, 0x2C, 0x2D, 0x2E, 0x2F,
-		0x30, 0x31, 0x32, 0x33, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39, 0x3A, 0x3B, 0x3C, 0x3D, 0x3E, 0x3F:
-		result = int(code) & 0xFF
-
-	case 0x40, 0x41, 0x42, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49, 0x4A, 0x4B, 0x4C, 0x4D, 0x4E, 0x4F,
-		0x50, 0x51, 0x52, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59, 0x5A, 0x5B, 0x5C, 0x5D, 0x5E, 0x5F:
-		result = ((int(code) - INT_PACKED_2_ZERO) << 8) | r.raw.readRawInt8()
-
-	case 0x60, 0x61, 0x62, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69, 0x6A, 0x6B, 0x6C, 0x6D, 0x6E, 0x6F:
-		result = ((int(code) - INT_PACKED_3_ZERO) << 16) | r.raw.readRawInt16()
-
-	case 0x70, 0x71, 0x72, 0x73:
-		result = ((int(code) - INT_PACKED_4_ZERO) << 24) | r.raw.readRawInt24()
-
-	case 0x74, 0x75, 0x76, 0x77:
-		result = ((int(code) - INT_PACKED_5_ZERO) << 32) | r.raw.readRawInt32()
-
-	case 0x78, 0x79, 0x7A, 0x7B:
-		result = ((int(code) - INT_PACKED_6_ZERO) << 40) | r.raw.readRawInt40()
-
-	case 0x7C, 0x7D, 0x7E, 0x7F:
-		result = ((int(code) - INT_PACKED_7_ZERO) << 48) | r.raw.readRawInt48()
-
-	case INT:
-		result = r.raw.readRawInt64()
+	return int(r.readInt64())
+}
+
+func (r *Reader) readInt64() int64 {
+	return r.readIntCode(r.readNextCode())
+}
+
+// isIntCode reports whether code starts an int.
+func isIntCode(code byte) bool {
+	return code < INT_PACKED_7_END || code == INT || code == INT_PACKED_1_START
+}
+
+func (r *Reader) readIntCode(code byte) int64 {
+	switch {
+	case code < INT_PACKED_2_START:
+		return int64(code)
+	case code == INT_PACKED_1_START:
+		return -1
+	case code < INT_PACKED_3_START:
+		return ((int64(code) - INT_PACKED_2_ZERO) << 8) | r.raw.readRawInt8()
+	case code < INT_PACKED_4_START:
+		return ((int64(code) - INT_PACKED_3_ZERO) << 16) | r.raw.readRawInt16()
+	case code < INT_PACKED_5_START:
+		return ((int64(code) - INT_PACKED_4_ZERO) << 24) | r.raw.readRawInt24()
+	case code < INT_PACKED_6_START:
+		return ((int64(code) - INT_PACKED_5_ZERO) << 32) | r.raw.readRawInt32()
+	case code < INT_PACKED_7_START:
+		return ((int64(code) - INT_PACKED_6_ZERO) << 40) | r.raw.readRawInt40()
+	case code < INT_PACKED_7_END:
+		return ((int64(code) - INT_PACKED_7_ZERO) << 48) | r.raw.readRawInt48()
+	case code == INT:
+		return r.raw.readRawInt64()
+	}
 
+	obj := r.read(code)
+	switch i := obj.(type) {
+	case int:
+		return int64(i)
+	case int64:
+		return i
 	default:
-		obj := r.read(code)
-		i, ok := obj.(int)
-		if ok {
-			return i
-		} else {
-			log.Fatalf("not an int: 0x%x, %#v\n", code, obj)
-		}
+		r.fail(fmt.Errorf("not an int: 0x%x, %#v", code, obj))
+		return 0
 	}
+}
 
-	return result
+// intValue returns i as an int, unless it doesn't fit into one or the
+// reader was created using WithInt64.
+func (r *Reader) intValue(i int64) interface{} {
+	if r.int64s || int64(int(i)) != i {
+		return i
+	}
+	return int(i)
 }
 
 func (r *Reader) readValue() interface{} {
@@ -197,34 +303,13 @@ func (r *Reader) readValue() interface{} {
 }
 
 func (r *Reader) read(code byte) interface{} {
+	if isIntCode(code) {
+		return r.intValue(r.readIntCode(code))
+	}
+
 	var result interface{}
 
 	switch code {
-	case 0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0A, 0x0B, 0x0C, 0x0D, 0x0E, 0x0F,
-		0x10, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18, 0x19, 0x1A, 0x1B, 0x1C, 0x1D, 0x1E, 0x1F,
-		0x20, 0x21, 0x22, 0x23, 0x24, 0x25, 0x26, 0x27, 0x28, 0x29, 0x2A, 0x2B, 0x2C, 0x2D, 0x2E, 0x2F,
-		0x30, 0x31, 0x32, 0x33, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39, 0x3A, 0x3B, 0x3C, 0x3D, 0x3E, 0x3F:
-		result = int(code) & 0xFF
-
-	case 0x40, 0x41, 0x42, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49, 0x4A, 0x4B, 0x4C, 0x4D, 0x4E, 0x4F,
-		0x50, 0x51, 0x52, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59, 0x5A, 0x5B, 0x5C, 0x5D, 0x5E, 0x5F:
-		result = ((int(code) - INT_PACKED_2_ZERO) << 8) | r.raw.readRawInt8()
-
-	case 0x60, 0x61, 0x62, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69, 0x6A, 0x6B, 0x6C, 0x6D, 0x6E, 0x6F:
-		result = ((int(code) - INT_PACKED_3_ZERO) << 16) | r.raw.readRawInt16()
-
-	case 0x70, 0x71, 0x72, 0x73:
-		result = ((int(code) - INT_PACKED_4_ZERO) << 24) | r.raw.readRawInt24()
-
-	case 0x74, 0x75, 0x76, 0x77:
-		result = ((int(code) - INT_PACKED_5_ZERO) << 32) | r.raw.readRawInt32()
-
-	case 0x78, 0x79, 0x7A, 0x7B:
-		result = ((int(code) - INT_PACKED_6_ZERO) << 40) | r.raw.readRawInt40()
-
-	case 0x7C, 0x7D, 0x7E, 0x7F:
-		result = ((int(code) - INT_PACKED_7_ZERO) << 48) | r.raw.readRawInt48()
-
 	case PUT_PRIORITY_CACHE:
 		idx := len(r.priorityCache)
 		r.priorityCache = append(r.priorityCache, underConstruction)
@@ -232,7 +317,7 @@ func (r *Reader) read(code byte) interface{} {
 		result = r.priorityCache[idx]
 
 	case GET_PRIORITY_CACHE:
-		result = lookupCache(r.priorityCache, r.readInt())
+		result = r.lookupCache(r.priorityCache, r.readInt())
 
 	case PRIORITY_CACHE_PACKED_START + 0, PRIORITY_CACHE_PACKED_START + 1,
 		PRIORITY_CACHE_PACKED_START + 2, PRIORITY_CACHE_PACKED_START + 3,
@@ -250,7 +335,7 @@ func (r *Reader) read(code byte) interface{} {
 		PRIORITY_CACHE_PACKED_START + 26, PRIORITY_CACHE_PACKED_START + 27,
 		PRIORITY_CACHE_PACKED_START + 28, PRIORITY_CACHE_PACKED_START + 29,
 		PRIORITY_CACHE_PACKED_START + 30, PRIORITY_CACHE_PACKED_START + 31:
-		result = lookupCache(r.priorityCache, int(code-PRIORITY_CACHE_PACKED_START))
+		result = r.lookupCache(r.priorityCache, int(code-PRIORITY_CACHE_PACKED_START))
 
 	case STRUCT_CACHE_PACKED_START + 0, STRUCT_CACHE_PACKED_START + 1,
 		STRUCT_CACHE_PACKED_START + 2, STRUCT_CACHE_PACKED_START + 3,
@@ -260,18 +345,48 @@ func (r *Reader) read(code byte) interface{} {
 		STRUCT_CACHE_PACKED_START + 10, STRUCT_CACHE_PACKED_START + 11,
 		STRUCT_CACHE_PACKED_START + 12, STRUCT_CACHE_PACKED_START + 13,
 		STRUCT_CACHE_PACKED_START + 14, STRUCT_CACHE_PACKED_START + 15:
-		st := lookupCache(r.structCache, int(code-STRUCT_CACHE_PACKED_START)).(structType)
-		result = r.handleStruct(st.tag, st.fields)
+		st, ok := r.lookupCache(r.structCache, int(code-STRUCT_CACHE_PACKED_START)).(StructType)
+		if !ok {
+			r.fail(errors.New("invalid struct cache entry"))
+			break
+		}
+		result = r.handleStruct(st.Tag, st.Fields)
 
 	case MAP:
-		kvs := r.readValue().([]interface{})
+		kvs, ok := r.readValue().([]interface{})
+		if !ok {
+			r.fail(errors.New("invalid map"))
+			break
+		}
+		if len(kvs)%2 != 0 {
+			r.fail(fmt.Errorf("invalid map: odd number of keys and values: %d", len(kvs)))
+			break
+		}
 		m := make(map[interface{}]interface{}, len(kvs)/2)
 		for i := 0; i < len(kvs); i += 2 {
+			if !hashable(reflect.ValueOf(kvs[i])) {
+				r.fail(fmt.Errorf("invalid map: unhashable key %#v", kvs[i]))
+				break
+			}
 			m[kvs[i]] = kvs[i+1]
 		}
 		result = m
 
-		// TODO: SET
+	case SET:
+		elems, ok := r.readValue().([]interface{})
+		if !ok {
+			r.fail(errors.New("invalid set"))
+			break
+		}
+		s := make(Set, len(elems))
+		for _, elem := range elems {
+			if !hashable(reflect.ValueOf(elem)) {
+				r.fail(fmt.Errorf("invalid set: unhashable element %#v", elem))
+				break
+			}
+			s[elem] = struct{}{}
+		}
+		result = s
 
 	case CODE_UUID:
 		result = r.handleStruct("uuid", 2)
@@ -282,62 +397,101 @@ func (r *Reader) read(code byte) interface{} {
 		result = r.handleStruct("uri", 1)
 
 	case BIGINT:
-		bs := r.readValue().([]byte)
+		bs, ok := r.readValue().([]byte)
+		if !ok {
+			r.fail(errors.New("invalid bigint"))
+			break
+		}
 		result = bigIntFromBytes(bs)
 
 	case BIGDEC:
 		// result = i * pow(10, -scale) = i * (1/pow(10, scale))
-		bs := r.readValue().([]byte)
+		bs, ok := r.readValue().([]byte)
+		if !ok {
+			r.fail(errors.New("invalid bigdec"))
+			break
+		}
 		i := bigIntFromBytes(bs)
 		d := new(big.Rat).SetInt(i)
-		scale := int64(r.readInt())
+		scale := r.readInt64()
 		exp := new(big.Int).Exp(big.NewInt(10), big.NewInt(scale), nil)
 		invExp := new(big.Rat).Inv(new(big.Rat).SetInt(exp))
 		result = d.Mul(d, invExp)
 
 	case INST:
-		milliseconds := int64(r.readInt())
-		result = time.Unix(milliseconds/1000, (milliseconds%1000)*10e6)
+		result = time.UnixMilli(r.readInt64()).In(r.location)
 
-		// TODO: SYM
+	case SYM:
+		result = r.handleStruct("sym", 2)
 
 	case KEY:
 		result = r.handleStruct("key", 2)
 
-	case INT_ARRAY, LONG_ARRAY:
+	case INT_ARRAY:
+		length := r.readCount()
+		nums := make([]int32, length)
+		for i := 0; i < length && r.err() == nil; i++ {
+			n := r.readInt64()
+			if n < math.MinInt32 || n > math.MaxInt32 {
+				r.fail(fmt.Errorf("invalid element of int array: %d", n))
+				break
+			}
+			nums[i] = int32(n)
+		}
+		result = nums
+
+	case LONG_ARRAY:
 		length := r.readCount()
-		nums := make([]int, length)
+		nums := make([]int64, length)
 		for i := 0; i < length; i++ {
-			nums[i] = r.readInt()
+			nums[i] = r.readInt64()
 		}
 		result = nums
 
 	case FLOAT_ARRAY:
 		length := r.readCount()
 		floats := make([]float32, length)
-		for i := 0; i < length; i++ {
-			floats[i] = r.readValue().(float32)
+		for i := 0; i < length && r.err() == nil; i++ {
+			val := r.readValue()
+			f, ok := val.(float32)
+			if !ok {
+				r.fail(fmt.Errorf("invalid element of float array: %#v", val))
+				break
+			}
+			floats[i] = f
 		}
 		result = floats
 
 	case BOOLEAN_ARRAY:
 		length := r.readCount()
 		bools := make([]bool, length)
-		for i := 0; i < length; i++ {
-			bools[i] = r.readValue().(bool)
+		for i := 0; i < length && r.err() == nil; i++ {
+			val := r.readValue()
+			b, ok := val.(bool)
+			if !ok {
+				r.fail(fmt.Errorf("invalid element of bool array: %#v", val))
+				break
+			}
+			bools[i] = b
 		}
 		result = bools
 
 	case DOUBLE_ARRAY:
 		length := r.readCount()
 		doubles := make([]float64, length)
-		for i := 0; i < length; i++ {
-			doubles[i] = r.readValue().(float64)
+		for i := 0; i < length && r.err() == nil; i++ {
+			val := r.readValue()
+			d, ok := val.(float64)
+			if !ok {
+				r.fail(fmt.Errorf("invalid element of double array: %#v", val))
+				break
+			}
+			doubles[i] = d
 		}
 		result = doubles
 
 	case OBJECT_ARRAY:
-		result = r.readValues(r.readCount())
+		result = ObjectArray(r.readValues(r.readCount()))
 
 	case BYTES_PACKED_LENGTH_START + 0, BYTES_PACKED_LENGTH_START + 1,
 		BYTES_PACKED_LENGTH_START + 2, BYTES_PACKED_LENGTH_START + 3,
@@ -365,7 +519,8 @@ func (r *Reader) read(code byte) interface{} {
 	case STRING:
 		result = r.internalReadString(r.readCount())
 
-		// TODO: STRING_CHUNK
+	case STRING_CHUNK:
+		result = r.internalReadChunkedString()
 
 	case LIST_PACKED_LENGTH_START + 0,
 		LIST_PACKED_LENGTH_START + 1,
@@ -376,11 +531,7 @@ func (r *Reader) read(code byte) interface{} {
 		LIST_PACKED_LENGTH_START + 6,
 		LIST_PACKED_LENGTH_START + 7:
 		length := int(code - LIST_PACKED_LENGTH_START)
-		list := make([]interface{}, length)
-		for i := 0; i < length; i++ {
-			list[i] = r.readValue()
-		}
-		result = list
+		result = r.readValues(length)
 
 	case LIST:
 		length := r.readCount()
@@ -390,6 +541,8 @@ func (r *Reader) read(code byte) interface{} {
 		result = r.readClosedList()
 
 	case BEGIN_OPEN_LIST:
+		// like the writer, footers count from here
+		r.raw.reset()
 		result = r.readOpenList()
 
 	case TRUE:
@@ -402,7 +555,7 @@ func (r *Reader) read(code byte) interface{} {
 		var double float64
 		err := binary.Read(bytes.NewBuffer(bs), binary.BigEndian, &double)
 		if err != nil {
-			log.Fatal("invalid double")
+			r.fail(errors.New("invalid double"))
 		}
 		result = double
 
@@ -413,45 +566,100 @@ func (r *Reader) read(code byte) interface{} {
 		result = float64(1.0)
 
 	case FLOAT:
-		result = -1.0
-
-	case INT:
-		result = r.raw.readRawInt64()
+		result = math.Float32frombits(uint32(r.raw.readRawInt32()))
 
 	case NULL:
 		result = nil
 
-		// TODO: FOOTER
+	case FOOTER:
+		length := r.raw.count - 1
+		magic := (int64(code) << 24) | r.raw.readRawInt24()
+		r.validateFooter(length, magic)
+		if r.err() == nil {
+			result = r.readValue()
+		}
 
 	case STRUCTTYPE:
-		tag := r.readValue().(string)
-		fields := r.readInt()
-		r.structCache = append(r.structCache, structType{tag, fields})
+		tag, ok := r.readValue().(string)
+		if !ok {
+			r.fail(errors.New("invalid struct tag"))
+			break
+		}
+		fields := r.readCount()
+		r.structCache = append(r.structCache, StructType{tag, fields})
 		result = r.handleStruct(tag, fields)
 
 	case STRUCT:
-		st := lookupCache(r.structCache, r.readInt()).(structType)
-		result = r.handleStruct(st.tag, st.fields)
+		st, ok := r.lookupCache(r.structCache, r.readInt()).(StructType)
+		if !ok {
+			r.fail(errors.New("invalid struct cache entry"))
+			break
+		}
+		result = r.handleStruct(st.Tag, st.Fields)
 
 	case RESET_CACHES:
-		r.priorityCache = make([]interface{}, 0, 32)
-		r.structCache = make([]interface{}, 0, 16)
+		r.resetCaches()
 		result = r.readValue()
 
 	default:
-		log.Fatalf("not implemented or invalid: 0x%x\n", code)
+		r.fail(fmt.Errorf("not implemented or invalid: 0x%x", code))
 	}
 
 	return result
 }
 
+// validateFooter checks the rest of a footer, and resets the caches
+// if it is valid.
+func (r *Reader) validateFooter(length int, magic int64) {
+	if magic != FOOTER_MAGIC {
+		r.raw.err = fmt.Errorf("invalid footer magic: 0x%x", magic)
+		return
+	}
+
+	lengthFromStream := r.raw.readRawInt32()
+	if lengthFromStream != int64(length) {
+		r.raw.err = fmt.Errorf("invalid footer length: expected %d, but was %d", length, lengthFromStream)
+		return
+	}
+
+	checksum := int64(r.raw.checksum.Sum32())
+	checksumFromStream := r.raw.readRawInt32()
+	if checksumFromStream != checksum {
+		r.raw.err = fmt.Errorf("invalid footer checksum: expected 0x%x, but was 0x%x", checksum, checksumFromStream)
+		return
+	}
+
+	r.raw.reset()
+	r.resetCaches()
+}
+
+// resetCaches empties the caches, or resets them to the dictionary
+// if there is one.
+func (r *Reader) resetCaches() {
+	r.priorityCache = make([]interface{}, 0, 32)
+	r.structCache = make([]interface{}, 0, 16)
+	if r.dictionary != nil {
+		r.priorityCache = append(r.priorityCache, r.dictionary.Values...)
+		for _, st := range r.dictionary.Structs {
+			r.structCache = append(r.structCache, st)
+		}
+	}
+}
+
+// readCount reads the number of elements or bytes of a value, which
+// can't be negative.
 func (r *Reader) readCount() int {
-	return r.readInt()
+	n := r.readInt()
+	if n < 0 {
+		r.fail(fmt.Errorf("invalid count: %d", n))
+		return 0
+	}
+	return n
 }
 
 func (r *Reader) readValues(length int) []interface{} {
 	list := make([]interface{}, length)
-	for i := 0; i < length; i++ {
+	for i := 0; i < length && r.err() == nil; i++ {
 		list[i] = r.readValue()
 	}
 	return list
@@ -459,9 +667,7 @@ func (r *Reader) readValues(length int) []interface{} {
 
 func (r *Reader) internalReadBytes(length int) []byte {
 	bs := make([]byte, length)
-	for i := 0; i < length; i++ {
-		bs[i] = r.raw.readRawByte()
-	}
+	r.raw.readRawBytes(bs)
 	return bs
 }
 
@@ -473,34 +679,89 @@ func (r *Reader) internalReadChunkedBytes() []byte {
 		code = r.readNextCode()
 	}
 	if code != BYTES {
-		log.Fatal("invalid byte chunk")
+		r.fail(errors.New("invalid byte chunk"))
 	}
 	bs = append(bs, r.internalReadBytes(r.readCount())...)
 	return bs
 }
 
 func (r *Reader) internalReadString(length int) string {
-	bs := make([]byte, length)
-	for i := 0; i < length; i++ {
-		bs[i] = r.raw.readRawByte()
+	return decodeString(r.internalReadBytes(length))
+}
+
+// internalReadChunkedString reads the chunks of a string after the
+// first STRING_CHUNK code.  The chunks are decoded together, because
+// Java may split a supplementary character between them.
+func (r *Reader) internalReadChunkedString() string {
+	bs := r.internalReadBytes(r.readCount())
+	for r.err() == nil {
+		code := r.readNextCode()
+		switch {
+		case code == STRING_CHUNK:
+			bs = append(bs, r.internalReadBytes(r.readCount())...)
+		case code == STRING:
+			bs = append(bs, r.internalReadBytes(r.readCount())...)
+			return decodeString(bs)
+		case code >= STRING_PACKED_LENGTH_START && code < STRING_PACKED_LENGTH_END:
+			bs = append(bs, r.internalReadBytes(int(code-STRING_PACKED_LENGTH_START))...)
+			return decodeString(bs)
+		default:
+			r.fail(errors.New("invalid string chunk"))
+		}
+	}
+	return ""
+}
+
+// decodeString decodes bs as written by Java, which encodes strings
+// like UTF-8, except that supplementary characters are written as two
+// 3-byte surrogates (CESU-8).
+func decodeString(bs []byte) string {
+	if utf8.Valid(bs) {
+		return string(bs)
+	}
+
+	var sb strings.Builder
+	for len(bs) > 0 {
+		ch, size := utf8.DecodeRune(bs)
+		if ch == utf8.RuneError && size == 1 {
+			if hi, ok := decodeSurrogate(bs); ok {
+				ch, size = utf8.RuneError, 3
+				if lo, ok := decodeSurrogate(bs[3:]); ok {
+					if pair := utf16.DecodeRune(hi, lo); pair != utf8.RuneError {
+						ch, size = pair, 6
+					}
+				}
+			}
+		}
+		sb.WriteRune(ch)
+		bs = bs[size:]
 	}
-	return string(bs)
+	return sb.String()
+}
+
+// decodeSurrogate decodes a surrogate encoded in 3 bytes like UTF-8.
+func decodeSurrogate(bs []byte) (rune, bool) {
+	if len(bs) < 3 || bs[0] != 0xed || bs[1]&0xe0 != 0xa0 || bs[2]&0xc0 != 0x80 {
+		return 0, false
+	}
+	return 0xd000 | rune(bs[1]&0x3f)<<6 | rune(bs[2]&0x3f), true
 }
 
 func (r *Reader) readClosedList() []interface{} {
 	list := make([]interface{}, 0)
-	for {
+	for r.err() == nil {
 		code := r.readNextCode()
 		if code == END_COLLECTION {
 			return list
 		}
 		list = append(list, r.read(code))
 	}
+	return list
 }
 
 func (r *Reader) readOpenList() []interface{} {
 	list := make([]interface{}, 0)
-	for {
+	for r.err() == nil {
 		code := r.readNextCode()
 		if r.err() == io.EOF {
 			r.raw.err = nil
@@ -511,76 +772,90 @@ func (r *Reader) readOpenList() []interface{} {
 		}
 		list = append(list, r.read(code))
 	}
+	return list
 }
 
-func (r *Reader) handleStruct(key string, fieldCount int) interface{} {
-	switch key {
-	case "key":
-		namespace := r.readValue()
-		if namespace == nil {
-			namespace = ""
-		}
-		name := r.readValue()
-		return Keyword{
-			Namespace: namespace.(string),
-			Name:      name.(string),
-		}
-
-	case "uuid":
-		obj := r.readValue()
-		bs, ok := obj.([]byte)
-		if !ok || len(bs) != 16 {
-			log.Fatal("invalid uuid")
+// readAll reads values until the end of the stream, or until the end
+// of the open list they are the elements of.
+func (r *Reader) readAll() ([]interface{}, error) {
+	vals := make([]interface{}, 0)
+	for {
+		code, err := r.raw.br.Peek(1)
+		if err == io.EOF || (err == nil && code[0] == END_COLLECTION) {
+			return vals, nil
+		} else if err != nil {
+			return vals, err
 		}
-		return NewUUIDFromBytes(bs)
 
-	case "uri":
-		rawURL := r.readValue().(string)
-		u, err := url.Parse(rawURL)
+		val, err := r.ReadValue()
 		if err != nil {
-			log.Fatal(err)
+			return vals, err
 		}
-		return u
+		vals = append(vals, val)
+	}
+}
 
-	default:
-		if handler, ok := r.handlers[key]; ok {
-			return handler(r, key, fieldCount)
+// hashable reports whether v can be used as a key of a Go map.
+func hashable(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map, reflect.Func:
+		return false
+	case reflect.Interface:
+		return v.IsNil() || hashable(v.Elem())
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if !hashable(v.Index(i)) {
+				return false
+			}
 		}
-
-		vals := r.readValues(fieldCount)
-		return StructAny{key, vals}
+		return true
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if !hashable(v.Field(i)) {
+				return false
+			}
+		}
+		return true
+	default:
+		return true
 	}
+}
 
-	return nil
+func (r *Reader) handleStruct(key string, fieldCount int) interface{} {
+	return r.handlers.Lookup(key)(r, key, fieldCount)
 }
 
+// bigIntFromBytes reads the two's complement bs, as written by Java's
+// BigInteger#toByteArray.
 func bigIntFromBytes(bs []byte) *big.Int {
-	negative := (bs[0] >> 7) == 1
 	i := new(big.Int)
-	if negative {
-		for i, _ := range bs {
-			bs[i] = 0xff ^ bs[i]
-		}
-		bs[len(bs)-1] += 1
-		i = i.SetBytes(bs)
-		return i.Neg(i)
-	} else {
+	if len(bs) == 0 || bs[0]&0x80 == 0 {
 		return i.SetBytes(bs)
 	}
+
+	// -x is the complement of x - 1
+	complement := make([]byte, len(bs))
+	for k, b := range bs {
+		complement[k] = ^b
+	}
+	i.SetBytes(complement)
+	i.Add(i, big.NewInt(1))
+	return i.Neg(i)
 }
 
-func lookupCache(cache []interface{}, idx int) interface{} {
-	if idx < len(cache) {
-		obj := cache[idx]
-		if obj == underConstruction {
-			log.Fatal("circular reference in cache!")
-		} else {
-			return obj
-		}
-	} else {
-		log.Fatal("cache index out of range ", idx)
+func (r *Reader) lookupCache(cache []interface{}, idx int) interface{} {
+	if r.err() != nil {
+		return nil
+	}
+	if idx < 0 || idx >= len(cache) {
+		r.fail(fmt.Errorf("cache index out of range: %d", idx))
+		return nil
 	}
 
-	log.Fatal("unreachable")
-	return nil
+	obj := cache[idx]
+	if obj == underConstruction {
+		r.fail(errors.New("circular reference in cache"))
+		return nil
+	}
+	return obj
 }
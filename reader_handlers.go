@@ -0,0 +1,141 @@
+package fressian
+
+import (
+	"errors"
+	"net/url"
+)
+
+// ReadHandlers is a registry of ReadHandlers, keyed by tag.
+//
+// Registries can be layered: a tag that is not registered with a
+// registry is looked up in its parent, and finally in the core
+// handlers for "key", "sym", "uuid" and "uri".  Registering one of
+// those tags overrides the core handler.
+type ReadHandlers struct {
+	handlers map[string]ReadHandler
+	parent   *ReadHandlers
+	dflt     ReadHandler
+}
+
+// NewReadHandlers creates an empty registry that falls back to parent,
+// or to the core handlers if parent is nil.
+func NewReadHandlers(parent *ReadHandlers) *ReadHandlers {
+	if parent == nil {
+		parent = coreReadHandlers
+	}
+	return &ReadHandlers{make(map[string]ReadHandler), parent, nil}
+}
+
+// Add registers handler for tag.  It returns h so that calls can be
+// chained.
+func (h *ReadHandlers) Add(tag string, handler ReadHandler) *ReadHandlers {
+	h.handlers[tag] = handler
+	return h
+}
+
+// AddMap registers all handlers in m.
+func (h *ReadHandlers) AddMap(m map[string]ReadHandler) *ReadHandlers {
+	for tag, handler := range m {
+		h.handlers[tag] = handler
+	}
+	return h
+}
+
+// SetDefault sets the handler used for tags that neither h nor any of
+// its parents have a handler for.  Without a default handler such
+// values are read as StructAny.
+func (h *ReadHandlers) SetDefault(handler ReadHandler) *ReadHandlers {
+	h.dflt = handler
+	return h
+}
+
+// Lookup returns the handler for tag.
+func (h *ReadHandlers) Lookup(tag string) ReadHandler {
+	for rh := h; rh != nil; rh = rh.parent {
+		if handler, ok := rh.handlers[tag]; ok {
+			return handler
+		}
+	}
+
+	for rh := h; rh != nil; rh = rh.parent {
+		if rh.dflt != nil {
+			return rh.dflt
+		}
+	}
+
+	return readStructAny
+}
+
+var coreReadHandlers = &ReadHandlers{
+	map[string]ReadHandler{
+		"key":  readKeyword,
+		"sym":  readSymbol,
+		"uuid": readUUID,
+		"uri":  readURI,
+	},
+	nil,
+	nil,
+}
+
+func readKeyword(r *Reader, tag string, fieldCount int) interface{} {
+	namespace := r.readValue()
+	if namespace == nil {
+		namespace = ""
+	}
+	ns, ok1 := namespace.(string)
+	name, ok2 := r.readValue().(string)
+	if !ok1 || !ok2 {
+		r.fail(errors.New("invalid keyword"))
+		return nil
+	}
+	return Keyword{
+		Namespace: ns,
+		Name:      name,
+	}
+}
+
+func readSymbol(r *Reader, tag string, fieldCount int) interface{} {
+	namespace := r.readValue()
+	if namespace == nil {
+		namespace = ""
+	}
+	ns, ok1 := namespace.(string)
+	name, ok2 := r.readValue().(string)
+	if !ok1 || !ok2 {
+		r.fail(errors.New("invalid symbol"))
+		return nil
+	}
+	return Symbol{
+		Namespace: ns,
+		Name:      name,
+	}
+}
+
+func readUUID(r *Reader, tag string, fieldCount int) interface{} {
+	obj := r.readValue()
+	bs, ok := obj.([]byte)
+	if !ok || len(bs) != 16 {
+		r.fail(errors.New("invalid uuid"))
+		return nil
+	}
+	return NewUUIDFromBytes(bs)
+}
+
+func readURI(r *Reader, tag string, fieldCount int) interface{} {
+	rawURL, ok := r.readValue().(string)
+	if !ok {
+		r.fail(errors.New("invalid uri"))
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		r.fail(err)
+		return nil
+	}
+	return u
+}
+
+func readStructAny(r *Reader, tag string, fieldCount int) interface{} {
+	vals := r.readValues(fieldCount)
+	return StructAny{tag, vals}
+}
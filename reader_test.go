@@ -2,6 +2,7 @@ package fressian
 
 import (
 	"bytes"
+	"reflect"
 	"testing"
 	"time"
 
@@ -46,14 +47,14 @@ func TestReadValue(t *testing.T) {
 	expectReadValue(t, []byte{0x72, 0x00, 0x00, 0x00}, 0)
 	expectReadValue(t, []byte{0x73, 0xFF, 0xFF, 0xFF}, 33554431)
 	// INT_PACKED_5
-	expectReadValue(t, []byte{0x74, 0x00, 0x00, 0x00, 0x00}, -8589934592)
-	expectReadValue(t, []byte{0x77, 0xFF, 0xFF, 0xFF, 0xFF}, 8589934591)
+	expectReadInt64(t, []byte{0x74, 0x00, 0x00, 0x00, 0x00}, -8589934592)
+	expectReadInt64(t, []byte{0x77, 0xFF, 0xFF, 0xFF, 0xFF}, 8589934591)
 	// INT_PACKED_6
-	expectReadValue(t, []byte{0x78, 0x00, 0x00, 0x00, 0x00, 0x00}, -2199023255552)
-	expectReadValue(t, []byte{0x7B, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, 2199023255551)
+	expectReadInt64(t, []byte{0x78, 0x00, 0x00, 0x00, 0x00, 0x00}, -2199023255552)
+	expectReadInt64(t, []byte{0x7B, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, 2199023255551)
 	// INT_PACKED_7
-	expectReadValue(t, []byte{0x7C, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, -562949953421312)
-	expectReadValue(t, []byte{0x7F, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, 562949953421311)
+	expectReadInt64(t, []byte{0x7C, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, -562949953421312)
+	expectReadInt64(t, []byte{0x7F, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, 562949953421311)
 
 	expectReadValue(t, []byte{TRUE}, true)
 	expectReadValue(t, []byte{FALSE}, false)
@@ -98,11 +99,103 @@ func TestReadValue(t *testing.T) {
 	if !ok {
 		t.Fatalf("expected a time.Time, but got %#v", obj)
 	}
-	tu.ExpectEqual(t, date.Unix(), int64(1426182820))
+	tu.ExpectEqual(t, date.UnixMilli(), int64(1426182819190))
+	tu.ExpectEqual(t, date.Location(), time.UTC)
+
+	expectReadValue(t, []byte{FLOAT, 0x3f, 0x9e, 0x04, 0x19}, float32(1.2345))
+	expectReadDeepEqual(t, []byte{INT_ARRAY, 0x03, 0x01, 0x02, 0x03}, []int32{1, 2, 3})
+	expectReadDeepEqual(t, []byte{LONG_ARRAY, 0x03, 0x01, 0x02, 0x03}, []int64{1, 2, 3})
+	expectReadDeepEqual(t, []byte{DOUBLE_ARRAY, 0x02, DOUBLE_0, DOUBLE_1}, []float64{0, 1})
+	expectReadDeepEqual(t, []byte{OBJECT_ARRAY, 0x02, 0x01, NULL}, ObjectArray{1, nil})
 
 	readValueTagged(t, []byte{KEY, STRING_PACKED_LENGTH_START + 2, 0x61, 0x62, STRING_PACKED_LENGTH_START + 1, 0x63}, Keyword{Namespace: "ab", Name: "c"})
 }
 
+func TestReadInvalidArrays(t *testing.T) {
+	for _, bs := range [][]byte{
+		{FLOAT_ARRAY, 0x02, FLOAT, 0x3f, 0x9e, 0x04, 0x19, 0x01},
+		{DOUBLE_ARRAY, 0x01, TRUE},
+		{BOOLEAN_ARRAY, 0x02, TRUE, DOUBLE_0},
+		{INT_ARRAY, 0x01, INT, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00},
+	} {
+		_, err := newReader(bs).ReadValue()
+		tu.ExpectNotNil(t, err)
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	for _, bs := range [][]byte{
+		{SET, 0x01},
+		{SET, LIST_PACKED_LENGTH_START + 1, LIST_PACKED_LENGTH_START},
+		{MAP, 0x01},
+		{KEY, 0x01, 0x02},
+		{CODE_UUID, BYTES_PACKED_LENGTH_START + 2, 0x01, 0x02},
+		{URI, TRUE},
+		{PRIORITY_CACHE_PACKED_START + 3},
+		{STRUCT_CACHE_PACKED_START},
+		{STRUCTTYPE, 0x01, 0x02},
+		{BYTES_CHUNK, 0x01, 0xaa, TRUE},
+		{STRING_CHUNK, 0x01, 'a', TRUE},
+		{BIGINT, 0x01},
+		{BIGDEC, 0x01, 0x00},
+		{MAP, LIST_PACKED_LENGTH_START + 1, 0x01},
+		{MAP, LIST_PACKED_LENGTH_START + 2, LIST_PACKED_LENGTH_START + 1, 0x01, 0x02},
+		{LIST, INT_PACKED_1_START},
+		{BYTES, INT_PACKED_1_START},
+		{STRUCTTYPE, STRING_PACKED_LENGTH_START + 1, 'a', INT_PACKED_1_START},
+		{BEGIN_CLOSED_LIST, 0x01},
+		{BEGIN_OPEN_LIST, 0x01, BIGINT, 0x01, 0x02},
+	} {
+		_, err := newReader(bs).ReadValue()
+		if err == nil {
+			t.Errorf("expected an error reading % x", bs)
+		}
+	}
+
+	r := NewGzipReader(bytes.NewReader([]byte("not gzip")), nil)
+	_, err := r.ReadValue()
+	tu.ExpectNotNil(t, err)
+}
+
+func TestReadHandlers(t *testing.T) {
+	uri := []byte{URI, STRING_PACKED_LENGTH_START + 1, 0x61}
+	point := []byte{STRUCTTYPE, STRING_PACKED_LENGTH_START + 5, 0x70, 0x6f, 0x69, 0x6e, 0x74, 0x02, 0x01, 0x02}
+
+	readURI := func(r *Reader, tag string, fieldCount int) interface{} {
+		s, _ := r.ReadValue()
+		return "uri:" + s.(string)
+	}
+	readPoint := func(r *Reader, tag string, fieldCount int) interface{} {
+		x, _ := r.ReadValue()
+		y, _ := r.ReadValue()
+		return [2]int{x.(int), y.(int)}
+	}
+	readUnknown := func(r *Reader, tag string, fieldCount int) interface{} {
+		r.readValues(fieldCount)
+		return tag
+	}
+
+	base := NewReadHandlers(nil).Add("point", readPoint)
+	handlers := NewReadHandlers(base).Add("uri", readURI)
+
+	r := NewReader(bytes.NewReader(uri), nil, WithReadHandlers(handlers))
+	tu.ExpectEqual(t, r.readValue(), "uri:a")
+	r = NewReader(bytes.NewReader(point), nil, WithReadHandlers(handlers))
+	tu.ExpectEqual(t, r.readValue(), [2]int{1, 2})
+
+	expectReadDeepEqual(t, point, StructAny{"point", []interface{}{1, 2}})
+	r = NewReader(bytes.NewReader(point), nil, WithReadHandlers(NewReadHandlers(nil).SetDefault(readUnknown)))
+	tu.ExpectEqual(t, r.readValue(), "point")
+
+	// a map of handlers is added to the registry
+	r = NewReader(bytes.NewReader(point), map[string]ReadHandler{"point": readUnknown}, WithReadHandlers(handlers))
+	tu.ExpectEqual(t, r.readValue(), "point")
+	r = NewReader(bytes.NewReader(uri), map[string]ReadHandler{"point": readUnknown}, WithReadHandlers(handlers))
+	tu.ExpectEqual(t, r.readValue(), "uri:a")
+	r = NewReader(bytes.NewReader(uri), map[string]ReadHandler{"uri": readUnknown})
+	tu.ExpectEqual(t, r.readValue(), "uri")
+}
+
 func expectReadValue(t *testing.T, bs []byte, res interface{}) {
 	r := newReader(bs)
 	obj := r.readValue()
@@ -110,6 +203,27 @@ func expectReadValue(t *testing.T, bs []byte, res interface{}) {
 	tu.ExpectEqual(t, obj, res)
 }
 
+// expectReadInt64 checks ints that don't fit into an int on 32-bit
+// platforms, which are returned as int64 there.
+func expectReadInt64(t *testing.T, bs []byte, res int64) {
+	r := newReader(bs)
+	obj := r.readValue()
+	tu.RequireNil(t, r.err())
+	tu.ExpectEqual(t, obj, r.intValue(res))
+
+	r = NewReader(bytes.NewReader(bs), nil, WithInt64())
+	obj = r.readValue()
+	tu.RequireNil(t, r.err())
+	tu.ExpectEqual(t, obj, res)
+}
+
+func expectReadDeepEqual(t *testing.T, bs []byte, res interface{}) {
+	obj := readValue(t, bs)
+	if !reflect.DeepEqual(obj, res) {
+		t.Errorf("Expected reflect.DeepEqual(%#v, %#v)", obj, res)
+	}
+}
+
 func readValueBytes(t *testing.T, bs []byte, res []byte) []byte {
 	bytes := readValue(t, bs).([]byte)
 	tu.RequireEqual(t, len(bytes), len(res))
@@ -0,0 +1,309 @@
+package fressian
+
+import (
+	"bufio"
+	"fmt"
+	"hash"
+	"hash/adler32"
+	"io"
+)
+
+// span is a range of bytes containing complete top-level values.
+type span struct {
+	start, end int64
+}
+
+// scanner skips over fressian values without decoding them, to find
+// the places at which a stream can be split.
+//
+// It only keeps track of the field counts of the struct cache, which
+// are needed to know how many values a struct consists of, and of the
+// length and checksum of the bytes since the last footer, to check
+// footers like Reader does.
+type scanner struct {
+	br         *bufio.Reader
+	pos        int64
+	count      int64
+	checksum   hash.Hash32
+	buf        [1]byte
+	structs    []int
+	dictionary *Dictionary
+	err        error
+}
+
+func newScanner(r io.Reader, dictionary *Dictionary) *scanner {
+	s := &scanner{br: bufio.NewReaderSize(r, 1<<16), checksum: adler32.New(), dictionary: dictionary}
+	s.resetCaches()
+	return s
+}
+
+func (s *scanner) resetChecksum() {
+	s.count = 0
+	s.checksum.Reset()
+}
+
+func (s *scanner) resetCaches() {
+	s.structs = s.structs[:0]
+	if s.dictionary != nil {
+		for _, st := range s.dictionary.Structs {
+			s.structs = append(s.structs, st.Fields)
+		}
+	}
+}
+
+func (s *scanner) fail(err error) {
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+func (s *scanner) readByte() byte {
+	b, err := s.br.ReadByte()
+	if err != nil {
+		s.fail(err)
+		return 0
+	}
+	s.pos++
+	s.count++
+	s.buf[0] = b
+	s.checksum.Write(s.buf[:])
+	return b
+}
+
+func (s *scanner) skipBytes(n int) {
+	if n < 0 {
+		s.fail(fmt.Errorf("invalid length %d at %d", n, s.pos))
+		return
+	}
+	skipped, err := io.CopyN(s.checksum, s.br, int64(n))
+	s.pos += skipped
+	s.count += skipped
+	if err != nil {
+		s.fail(err)
+	}
+}
+
+// scanSpans splits the values in r into spans of at least minSize
+// bytes.  Spans start at the beginning of the stream, at RESET_CACHES
+// and after footers, because at these points the caches are empty.
+//
+// If the stream is a list started with BEGIN_OPEN_LIST, the spans
+// contain its elements instead.
+func (s *scanner) scanSpans(minSize int64) ([]span, error) {
+	spans := make([]span, 0)
+	cur := span{0, 0}
+	addSpan := func(end int64) {
+		cur.end = end
+		if cur.end > cur.start {
+			spans = append(spans, cur)
+		}
+	}
+
+	code, err := s.br.Peek(1)
+	if err == io.EOF {
+		return spans, nil
+	} else if err != nil {
+		return nil, err
+	}
+	openList := code[0] == BEGIN_OPEN_LIST
+	if openList {
+		s.readByte()
+		s.resetChecksum()
+		cur.start = s.pos
+	}
+
+	for {
+		if _, err := s.br.Peek(1); err == io.EOF {
+			addSpan(s.pos)
+			return spans, nil
+		}
+
+		start := s.pos
+		code := s.readByte()
+		switch {
+		case code == END_COLLECTION && openList:
+			addSpan(start)
+			return spans, nil
+
+		case code == FOOTER:
+			addSpan(start)
+			s.checkFooter(start)
+			s.resetCaches()
+			cur = span{s.pos, 0}
+
+		case code == RESET_CACHES:
+			if start-cur.start >= minSize {
+				addSpan(start)
+				cur = span{start, 0}
+			}
+			s.resetCaches()
+
+		default:
+			s.skip(code)
+		}
+
+		if s.err != nil {
+			if s.err == io.EOF {
+				s.err = io.ErrUnexpectedEOF
+			}
+			return nil, s.err
+		}
+	}
+}
+
+// checkFooter checks the footer at pos, whose first byte was read.
+func (s *scanner) checkFooter(pos int64) {
+	length := s.count - 1
+	magic := (int64(FOOTER) << 24) | s.readRaw(3)
+	lengthFromStream := s.readRaw(4)
+	checksum := int64(s.checksum.Sum32())
+	checksumFromStream := s.readRaw(4)
+	if s.err != nil {
+		return
+	}
+
+	switch {
+	case magic != FOOTER_MAGIC:
+		s.fail(fmt.Errorf("invalid footer magic at %d: 0x%x", pos, magic))
+	case lengthFromStream != length:
+		s.fail(fmt.Errorf("invalid footer length at %d: expected %d, but was %d", pos, length, lengthFromStream))
+	case checksumFromStream != checksum:
+		s.fail(fmt.Errorf("invalid footer checksum at %d: expected 0x%x, but was 0x%x", pos, checksum, checksumFromStream))
+	}
+	s.resetChecksum()
+}
+
+// readRaw reads an n bytes long big-endian integer.
+func (s *scanner) readRaw(n int) int64 {
+	var i int64
+	for ; n > 0; n-- {
+		i = (i << 8) | int64(s.readByte())
+	}
+	return i
+}
+
+func (s *scanner) readInt() int {
+	return int(s.readIntCode(s.readByte()))
+}
+
+func (s *scanner) readIntCode(code byte) int64 {
+	switch {
+	case code < INT_PACKED_2_START || code == INT_PACKED_1_START:
+		return int64(int8(code))
+	case code < INT_PACKED_3_START:
+		return ((int64(code) - INT_PACKED_2_ZERO) << 8) | s.readRaw(1)
+	case code < INT_PACKED_4_START:
+		return ((int64(code) - INT_PACKED_3_ZERO) << 16) | s.readRaw(2)
+	case code < INT_PACKED_5_START:
+		return ((int64(code) - INT_PACKED_4_ZERO) << 24) | s.readRaw(3)
+	case code < INT_PACKED_6_START:
+		return ((int64(code) - INT_PACKED_5_ZERO) << 32) | s.readRaw(4)
+	case code < INT_PACKED_7_START:
+		return ((int64(code) - INT_PACKED_6_ZERO) << 40) | s.readRaw(5)
+	case code < INT_PACKED_7_END:
+		return ((int64(code) - INT_PACKED_7_ZERO) << 48) | s.readRaw(6)
+	case code == INT:
+		return s.readRaw(8)
+	default:
+		s.fail(fmt.Errorf("expected an int at %d, but got 0x%x", s.pos-1, code))
+		return 0
+	}
+}
+
+func (s *scanner) skipValue() {
+	s.skip(s.readByte())
+}
+
+func (s *scanner) skipValues(n int) {
+	for i := 0; i < n && s.err == nil; i++ {
+		s.skipValue()
+	}
+}
+
+// skip skips the rest of the value starting with code.
+func (s *scanner) skip(code byte) {
+	switch {
+	case code < INT_PACKED_7_END || code == INT || code == INT_PACKED_1_START:
+		s.readIntCode(code)
+
+	case code >= PRIORITY_CACHE_PACKED_START && code < PRIORITY_CACHE_PACKED_END:
+
+	case code >= STRUCT_CACHE_PACKED_START && code < STRUCT_CACHE_PACKED_END:
+		s.skipStruct(int(code - STRUCT_CACHE_PACKED_START))
+
+	case code >= BYTES_PACKED_LENGTH_START && code < BYTES_PACKED_LENGTH_END:
+		s.skipBytes(int(code - BYTES_PACKED_LENGTH_START))
+
+	case code >= STRING_PACKED_LENGTH_START && code < STRING_PACKED_LENGTH_END:
+		s.skipBytes(int(code - STRING_PACKED_LENGTH_START))
+
+	case code >= LIST_PACKED_LENGTH_START && code < LIST_PACKED_LENGTH_END:
+		s.skipValues(int(code - LIST_PACKED_LENGTH_START))
+
+	default:
+		switch code {
+		case TRUE, FALSE, NULL, DOUBLE_0, DOUBLE_1:
+
+		case FLOAT:
+			s.skipBytes(4)
+
+		case DOUBLE:
+			s.skipBytes(8)
+
+		case BYTES, STRING:
+			s.skipBytes(s.readInt())
+
+		case BYTES_CHUNK, STRING_CHUNK:
+			s.skipBytes(s.readInt())
+			s.skipValue()
+
+		case LIST:
+			s.skipValues(s.readInt())
+
+		case BEGIN_CLOSED_LIST, BEGIN_OPEN_LIST:
+			for s.err == nil {
+				code := s.readByte()
+				if code == END_COLLECTION {
+					break
+				}
+				s.skip(code)
+			}
+
+		case LONG_ARRAY, DOUBLE_ARRAY, BOOLEAN_ARRAY, INT_ARRAY, FLOAT_ARRAY, OBJECT_ARRAY:
+			s.skipValues(s.readInt())
+
+		case MAP, SET, CODE_UUID, REGEX, URI, BIGINT, INST, PUT_PRIORITY_CACHE:
+			s.skipValue()
+
+		case BIGDEC, SYM, KEY, META:
+			s.skipValues(2)
+
+		case GET_PRIORITY_CACHE:
+			s.readInt()
+
+		case STRUCTTYPE:
+			s.skipValue()
+			fields := s.readInt()
+			s.structs = append(s.structs, fields)
+			s.skipValues(fields)
+
+		case STRUCT:
+			s.skipStruct(s.readInt())
+
+		case RESET_CACHES:
+			s.resetCaches()
+			s.skipValue()
+
+		default:
+			s.fail(fmt.Errorf("not implemented or invalid: 0x%x at %d", code, s.pos-1))
+		}
+	}
+}
+
+func (s *scanner) skipStruct(idx int) {
+	if idx < 0 || idx >= len(s.structs) {
+		s.fail(fmt.Errorf("struct cache index out of range %d at %d", idx, s.pos))
+		return
+	}
+	s.skipValues(s.structs[idx])
+}
@@ -0,0 +1,161 @@
+package fressian
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// CycleError is returned when writing a value that contains itself,
+// which can't be represented in fressian.
+type CycleError struct {
+	Type reflect.Type
+	// Path is the path from the top-level value to the place where
+	// the value contains itself, e.g. [3][:name].
+	Path string
+}
+
+func (e *CycleError) Error() string {
+	return fmt.Sprintf("value of type %s contains itself at %s", e.Type, e.Path)
+}
+
+// identity identifies a pointer, map or slice by the memory it refers
+// to.
+type identity struct {
+	ptr uintptr
+	typ reflect.Type
+	len int
+}
+
+func identityOf(v reflect.Value) (identity, bool) {
+	switch v.Kind() {
+	case reflect.Map:
+		if v.Len() == 0 {
+			return identity{}, false
+		}
+		return identity{v.Pointer(), v.Type(), 0}, true
+	case reflect.Slice:
+		if v.Len() == 0 {
+			return identity{}, false
+		}
+		return identity{v.Pointer(), v.Type(), v.Len()}, true
+	case reflect.Ptr:
+		if v.IsNil() {
+			return identity{}, false
+		}
+		return identity{v.Pointer(), v.Type(), 0}, true
+	default:
+		return identity{}, false
+	}
+}
+
+// findRepeated returns the pointers, maps and slices that occur more
+// than once in val.
+func findRepeated(val interface{}) map[identity]bool {
+	counts := make(map[identity]int)
+	var walk func(v reflect.Value)
+	walk = func(v reflect.Value) {
+		switch v.Kind() {
+		case reflect.Interface:
+			if !v.IsNil() {
+				walk(v.Elem())
+			}
+			return
+		case reflect.Array:
+			if hasRefs(v.Type().Elem()) {
+				for i := 0; i < v.Len(); i++ {
+					walk(v.Index(i))
+				}
+			}
+			return
+		case reflect.Struct:
+			for i := 0; i < v.NumField(); i++ {
+				walk(v.Field(i))
+			}
+			return
+		}
+
+		id, ok := identityOf(v)
+		if !ok {
+			return
+		}
+		counts[id]++
+		if counts[id] > 1 {
+			// its contents were counted already
+			return
+		}
+		switch v.Kind() {
+		case reflect.Slice:
+			if hasRefs(v.Type().Elem()) {
+				for i := 0; i < v.Len(); i++ {
+					walk(v.Index(i))
+				}
+			}
+		case reflect.Map:
+			iter := v.MapRange()
+			for iter.Next() {
+				walk(iter.Key())
+				walk(iter.Value())
+			}
+		case reflect.Ptr:
+			walk(v.Elem())
+		}
+	}
+	walk(reflect.ValueOf(val))
+
+	repeated := make(map[identity]bool)
+	for id, n := range counts {
+		if n > 1 {
+			repeated[id] = true
+		}
+	}
+	return repeated
+}
+
+// hasRefs reports whether values of type t may contain pointers, maps
+// or slices.
+func hasRefs(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128:
+		return false
+	default:
+		return true
+	}
+}
+
+// writeTracked writes the pointer, map or slice v using write, unless
+// v is already being written, in which case it contains itself.
+//
+// With WithSharing, v is put into the priority cache and written only
+// once if it occurs more than once in the value being written.
+func (w *Writer) writeTracked(v reflect.Value, write func() error) error {
+	id, ok := identityOf(v)
+	if !ok {
+		return write()
+	}
+
+	if w.sharing {
+		if idx, ok := w.shared[id]; ok {
+			return w.writePriorityRef(idx)
+		}
+	}
+	if w.visiting[id] {
+		return &CycleError{Type: v.Type()}
+	}
+	w.visiting[id] = true
+	defer delete(w.visiting, id)
+
+	if !w.sharing || !w.repeated[id] {
+		return write()
+	}
+
+	start := w.raw.count
+	idx := w.priorityCache.reserve()
+	w.writeCode(PUT_PRIORITY_CACHE)
+	err := write()
+	w.cacheBytes += w.raw.count - start
+	w.shared[id] = idx
+	return err
+}
@@ -0,0 +1,166 @@
+package fressian
+
+import (
+	"context"
+	"io"
+)
+
+// streamBuffer is the number of values or chunks of output that
+// DecodeStream and EncodeStream keep ahead of their consumers.
+const streamBuffer = 64
+
+// DecodeStream reads values from r in a goroutine of its own, and
+// sends them on the returned channel.
+//
+// Both channels are closed once the end of r is reached, after an
+// error, or when ctx is cancelled.  Errors, including ctx.Err(), are
+// sent on the error channel before it is closed.
+//
+// The channels are closed when ctx is cancelled even if reading from r
+// blocks, but the read itself can't be interrupted: the goroutine
+// reading from r only exits once it returns.
+func DecodeStream(ctx context.Context, r io.Reader, handlers *ReadHandlers, opts ...Option) (<-chan interface{}, <-chan error) {
+	vals := make(chan interface{}, streamBuffer)
+	errs := make(chan error, 1)
+
+	type result struct {
+		val interface{}
+		err error
+	}
+	results := make(chan result)
+	stop := make(chan struct{})
+
+	go func() {
+		rd := newReaderWith(r, handlers, opts)
+		for {
+			val, err := rd.ReadValue()
+			select {
+			case results <- result{val, err}:
+			case <-stop:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer close(errs)
+		defer close(vals)
+		defer close(stop)
+
+		for {
+			if err := ctx.Err(); err != nil {
+				errs <- err
+				return
+			}
+
+			var res result
+			select {
+			case res = <-results:
+			case <-ctx.Done():
+				errs <- ctx.Err()
+				return
+			}
+			if res.err == io.EOF {
+				return
+			} else if res.err != nil {
+				errs <- res.err
+				return
+			}
+
+			select {
+			case vals <- res.val:
+			case <-ctx.Done():
+				errs <- ctx.Err()
+				return
+			}
+		}
+	}()
+
+	return vals, errs
+}
+
+// EncodeStream writes the values received from vals to w, until vals
+// is closed or ctx is cancelled.
+//
+// The output is written to w in a goroutine of its own, so that
+// encoding can continue while w is busy.  It is flushed whenever no
+// value is ready to be written.
+func EncodeStream(ctx context.Context, w io.Writer, vals <-chan interface{}, handlers *WriteHandlers, opts ...Option) error {
+	cw := &chunkWriter{
+		chunks: make(chan []byte, streamBuffer),
+		failed: make(chan struct{}),
+	}
+	done := make(chan struct{})
+	go cw.run(w, done)
+
+	err := encodeStream(ctx, newWriterWith(cw, handlers, opts), vals)
+	close(cw.chunks)
+	<-done
+	if err == nil {
+		err = cw.err
+	}
+	return err
+}
+
+func encodeStream(ctx context.Context, w *Writer, vals <-chan interface{}) error {
+	for {
+		var val interface{}
+		var ok bool
+		select {
+		case val, ok = <-vals:
+		default:
+			if err := w.Flush(); err != nil {
+				return err
+			}
+			select {
+			case val, ok = <-vals:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if !ok {
+			return w.Flush()
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := w.WriteValue(val); err != nil {
+			return err
+		}
+	}
+}
+
+// chunkWriter passes copies of the chunks written to it on to a
+// goroutine writing them, and fails once that goroutine did.
+type chunkWriter struct {
+	chunks chan []byte
+	failed chan struct{}
+	err    error
+}
+
+func (cw *chunkWriter) run(w io.Writer, done chan<- struct{}) {
+	defer close(done)
+	for chunk := range cw.chunks {
+		if _, err := w.Write(chunk); err != nil {
+			cw.err = err
+			close(cw.failed)
+			for range cw.chunks {
+			}
+			return
+		}
+	}
+}
+
+func (cw *chunkWriter) Write(p []byte) (int, error) {
+	chunk := append([]byte(nil), p...)
+	select {
+	case cw.chunks <- chunk:
+		return len(p), nil
+	case <-cw.failed:
+		return 0, cw.err
+	}
+}
@@ -0,0 +1,86 @@
+package fressian
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	tu "github.com/klingtnet/gol/util/testing"
+)
+
+func TestStream(t *testing.T) {
+	records := make([]interface{}, 1000)
+	for i := range records {
+		records[i] = []interface{}{Keyword{"record", "id"}, i}
+	}
+
+	in := make(chan interface{})
+	go func() {
+		for _, rec := range records {
+			in <- rec
+		}
+		close(in)
+	}()
+	buf := new(bytes.Buffer)
+	err := EncodeStream(context.Background(), buf, in, nil)
+	tu.ExpectNil(t, err)
+
+	vals, errs := DecodeStream(context.Background(), bytes.NewReader(buf.Bytes()), nil)
+	var res []interface{}
+	for val := range vals {
+		res = append(res, val)
+	}
+	tu.ExpectNil(t, <-errs)
+	if !reflect.DeepEqual(records, res) {
+		t.Errorf("Expected reflect.DeepEqual(%#v, %#v)", records, res)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	vals, errs = DecodeStream(ctx, bytes.NewReader(buf.Bytes()), nil)
+	<-vals
+	cancel()
+	for range vals {
+	}
+	tu.ExpectEqual(t, <-errs, context.Canceled)
+
+	// cancelling doesn't wait for a blocked read
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	ctx, cancel = context.WithCancel(context.Background())
+	vals, errs = DecodeStream(ctx, pr, nil)
+	cancel()
+	for range vals {
+	}
+	tu.ExpectEqual(t, <-errs, context.Canceled)
+
+	err = EncodeStream(ctx, buf, make(chan interface{}), nil)
+	tu.ExpectEqual(t, err, context.Canceled)
+}
+
+type failingWriter struct{}
+
+var errWrite = errors.New("write failed")
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errWrite
+}
+
+func TestEncodeStreamError(t *testing.T) {
+	in := make(chan interface{})
+	go func() {
+		defer close(in)
+		for i := 0; i < 100000; i++ {
+			select {
+			case in <- i:
+			case <-time.After(time.Second):
+				return
+			}
+		}
+	}()
+	err := EncodeStream(context.Background(), failingWriter{}, in, nil)
+	tu.ExpectEqual(t, err, errWrite)
+}
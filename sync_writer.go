@@ -0,0 +1,116 @@
+package fressian
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// SyncWriter is a Writer that can be used by several goroutines at
+// once.  Each call writes whole top-level values, which are never
+// interleaved with values written by other goroutines.
+//
+// By default the output is flushed after every call.  WithBatchSize
+// flushes only after the given number of calls, and WithFlushInterval
+// flushes periodically instead, or in addition.
+type SyncWriter struct {
+	mu        sync.Mutex
+	w         *Writer
+	batchSize int
+	interval  time.Duration
+	unflushed int
+	stop      chan struct{}
+	stopped   chan struct{}
+	stopOnce  sync.Once
+}
+
+// NewSyncWriter creates a SyncWriter writing to w.  If a flush interval
+// is given, Close must be called to stop the goroutine flushing it.
+func NewSyncWriter(w io.Writer, handlers *WriteHandlers, opts ...Option) *SyncWriter {
+	o := newOptions(opts)
+	sw := &SyncWriter{
+		w:         newWriterWith(w, handlers, opts),
+		batchSize: o.batchSize,
+		interval:  o.flushInterval,
+	}
+	if sw.batchSize <= 0 && sw.interval <= 0 {
+		sw.batchSize = 1
+	}
+
+	if sw.interval > 0 {
+		sw.stop = make(chan struct{})
+		sw.stopped = make(chan struct{})
+		go sw.flushPeriodically()
+	}
+	return sw
+}
+
+func (sw *SyncWriter) flushPeriodically() {
+	defer close(sw.stopped)
+	ticker := time.NewTicker(sw.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sw.Flush()
+		case <-sw.stop:
+			return
+		}
+	}
+}
+
+// WriteValue writes val, or nothing if it can't be written completely.
+func (sw *SyncWriter) WriteValue(val interface{}) error {
+	return sw.Do(func(w *Writer) error {
+		return w.WriteValue(val)
+	})
+}
+
+// Do calls fn with the underlying Writer, which no other goroutine
+// writes to until fn returns.  This allows writing several values, or
+// values that need WriteAs or WriteExt, in one go.
+//
+// What fn writes is kept only if it returns nil, like with
+// Writer.WriteRecord, so that a failed call leaves neither partial
+// values in the stream nor the writer failed for other goroutines.
+// fn must not call WriteRecord itself.
+func (sw *SyncWriter) Do(fn func(w *Writer) error) error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	err := sw.w.writeRecord(func() error {
+		return fn(sw.w)
+	})
+	if err != nil {
+		return err
+	}
+	sw.unflushed++
+	if sw.batchSize > 0 && sw.unflushed >= sw.batchSize {
+		return sw.flush()
+	}
+	return nil
+}
+
+func (sw *SyncWriter) flush() error {
+	sw.unflushed = 0
+	return sw.w.Flush()
+}
+
+// Flush writes any buffered values to the underlying writer.
+func (sw *SyncWriter) Flush() error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.flush()
+}
+
+// Close stops flushing periodically and flushes the writer.  It does
+// not close the underlying writer.
+func (sw *SyncWriter) Close() error {
+	sw.stopOnce.Do(func() {
+		if sw.stop != nil {
+			close(sw.stop)
+			<-sw.stopped
+		}
+	})
+	return sw.Flush()
+}
@@ -0,0 +1,112 @@
+package fressian
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	tu "github.com/klingtnet/gol/util/testing"
+)
+
+// syncBuffer is a bytes.Buffer that can be read while it is written.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Len()
+}
+
+func TestSyncWriter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewSyncWriter(buf, nil, WithBatchSize(16), WithAutoCache(AutoCache{Keywords: true}))
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				w.WriteValue(map[interface{}]interface{}{Keyword{"event", "goroutine"}: g, Keyword{"event", "id"}: i})
+			}
+		}(g)
+	}
+	wg.Wait()
+	tu.ExpectNil(t, w.Close())
+
+	next := make(map[int]int)
+	r := NewReader(buf, nil)
+	for {
+		val, err := r.ReadValue()
+		if err == io.EOF {
+			break
+		}
+		tu.RequireNil(t, err)
+		m := val.(map[interface{}]interface{})
+		g := m[Keyword{"event", "goroutine"}].(int)
+		tu.ExpectEqual(t, m[Keyword{"event", "id"}], next[g])
+		next[g]++
+	}
+	for g := 0; g < 8; g++ {
+		tu.ExpectEqual(t, next[g], 100)
+	}
+}
+
+func TestSyncWriterFlushInterval(t *testing.T) {
+	buf := new(syncBuffer)
+	w := NewSyncWriter(buf, nil, WithFlushInterval(time.Millisecond))
+	tu.ExpectNil(t, w.WriteValue("hello"))
+	for i := 0; i < 1000 && buf.Len() == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	tu.ExpectEqual(t, buf.Len(), 6)
+	tu.ExpectNil(t, w.Close())
+}
+
+func TestSyncWriterFailedDo(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewSyncWriter(buf, nil)
+	err := w.Do(func(w *Writer) error {
+		if err := w.WriteValue("partial"); err != nil {
+			return err
+		}
+		return w.WriteValue(make(chan int))
+	})
+	tu.ExpectNotNil(t, err)
+	tu.ExpectNotNil(t, w.WriteValue([]interface{}{"partial", make(chan int)}))
+	err = w.Do(func(w *Writer) error {
+		bw := w.BytesWriter()
+		bw.Write([]byte("partial"))
+		return errors.New("failed")
+	})
+	tu.ExpectNotNil(t, err)
+	tu.ExpectNil(t, w.WriteValue("complete"))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tu.ExpectNil(t, w.Close())
+		}()
+	}
+	wg.Wait()
+
+	r := NewReader(buf, nil)
+	val, err := r.ReadValue()
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, val, "complete")
+	_, err = r.ReadValue()
+	tu.ExpectEqual(t, err, io.EOF)
+}
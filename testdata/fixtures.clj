@@ -0,0 +1,75 @@
+; Writes the fixtures for TestWriteJavaCompatible using Java's
+; FressianWriter, run it using `make fixtures`.
+
+(import '(java.io File FileOutputStream))
+(import '(org.fressian FressianWriter))
+(import '(org.fressian.handlers ILookup WriteHandler))
+
+; writes keywords like the handler of data.fressian
+(def keyword-handler
+  (reify WriteHandler
+    (write [_ w kw]
+      (.writeTag w "key" 2)
+      (.writeObject w (namespace kw) true)
+      (.writeObject w (name kw) true))))
+
+(def handlers
+  (reify ILookup
+    (valAt [_ cls]
+      (when (= cls clojure.lang.Keyword)
+        {"key" keyword-handler}))))
+
+(defn fixture [name & fns]
+  (let [w (FressianWriter. (FileOutputStream. (File. (str "testdata/" name ".fressian"))) handlers)]
+    (doseq [f fns]
+      (f w))
+    (.close w)))
+
+(defn value [v] (fn [w] (.writeObject w v)))
+
+(defn point [x y]
+  (fn [w]
+    (.writeTag w "point" 2)
+    (.writeObject w x)
+    (.writeObject w y)))
+
+(defn line [from to]
+  (fn [w]
+    (.writeTag w "line" 2)
+    (from w)
+    (to w)))
+
+(defn bi [s] (java.math.BigInteger. s))
+
+(fixture "ints"
+  (value [89 33554431 0 -1 -64 -65 4095 -4096 524287 -524288
+          8589934591 42949672960 Long/MAX_VALUE Long/MIN_VALUE]))
+
+(fixture "floats" (value [(float 1.2345) 0.0 1.0 3.257329852835 -2.5]))
+
+(fixture "strings" (value ["" "hello" "Hello, World!" "hällo" "日本語" "a😀b" "\u0000"]))
+
+(fixture "bytes" (value [(byte-array (range 10)) (byte-array 3)]))
+
+(fixture "bigints"
+  (value (mapv bi ["0" "1" "2" "7" "1000" "1001"
+                   "-0" "-1" "-2" "-7" "-1000" "-1001"
+                   "424242424242424242"
+                   "-424242424242424242"])))
+
+(fixture "keywords" (value [:a :ns/b :a :ns/b :c/a]))
+
+(fixture "structs"
+  (point 1 2)
+  (point 3 4)
+  (line (point 5 6) (point 7 8))
+  (line (value nil) (value nil)))
+
+(fixture "map" (value {"answer" 42}))
+
+(fixture "misc"
+  (value [nil true false (java.util.Date. 1426182819190)
+          (java.util.UUID/fromString "f81d4fae-7dec-11d0-a765-00a0c91e6bf6")
+          (long-array [1 2 3])]))
+
+(fixture "lists" (value [(vec (range 7)) (vec (range 8)) []]))
@@ -2,98 +2,132 @@ package fressian
 
 import (
 	"bufio"
+	"bytes"
 	"compress/gzip"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash"
+	"hash/adler32"
 	"io"
-	"log"
-	"unicode/utf8"
+	"math"
+	"math/big"
+	"math/bits"
+	"reflect"
+	"strings"
+	"time"
+	"unicode/utf16"
 )
 
 type rawWriter struct {
-	bw    *bufio.Writer
-	count int
-	err   error
+	bw       *bufio.Writer
+	count    int
+	offset   int64
+	checksum hash.Hash32
+	err      error
+	staging  bool
+	staged   bytes.Buffer
+	// count and offset when staging started
+	stagedCount  int
+	stagedOffset int64
 }
 
 func newRawWriter(w io.Writer) *rawWriter {
-	return &rawWriter{bufio.NewWriter(w), 0, nil}
+	return &rawWriter{bw: bufio.NewWriter(w), checksum: adler32.New()}
 }
 
-func (w *rawWriter) writeRawByte(b byte) error {
-	err := w.bw.WriteByte(b)
-	if err != nil {
-		w.err = err
-		return err
+// write writes bs, keeping track of the number of bytes written and
+// their checksum.  Once writing failed, nothing is written anymore.
+func (w *rawWriter) write(bs []byte) error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.staging {
+		w.staged.Write(bs)
+		w.count += len(bs)
+		w.offset += int64(len(bs))
+		return nil
 	}
 
-	w.count++
-	return nil
+	n, err := w.output(bs)
+	w.count += n
+	w.offset += int64(n)
+	return err
 }
 
-func (w *rawWriter) writeRawInt16(i int) error {
-	n, err := w.bw.Write([]byte{
-		byte((i >> 8) & 0xff),
-		byte(i & 0xff)})
+// output writes bs to the underlying writer and adds them to the
+// checksum.
+func (w *rawWriter) output(bs []byte) (int, error) {
+	n, err := w.bw.Write(bs)
+	w.checksum.Write(bs[:n])
 	if err != nil {
 		w.err = err
-		return err
 	}
+	return n, err
+}
 
-	w.count += n
-	return nil
+// stage makes the writer hold back its output until commit or
+// rollback is called.
+func (w *rawWriter) stage() {
+	w.staging = true
+	w.staged.Reset()
+	w.stagedCount, w.stagedOffset = w.count, w.offset
+}
+
+// commit writes the output held back since stage was called.
+func (w *rawWriter) commit() error {
+	w.staging = false
+	_, err := w.output(w.staged.Bytes())
+	return err
 }
 
-func (w *rawWriter) writeRawInt24(i int) error {
-	n, err := w.bw.Write([]byte{
+// rollback discards the output held back since stage was called,
+// along with the error that made it fail.
+func (w *rawWriter) rollback() {
+	w.staging = false
+	w.count, w.offset = w.stagedCount, w.stagedOffset
+	w.err = nil
+}
+
+func (w *rawWriter) writeRawByte(b byte) error {
+	return w.write([]byte{b})
+}
+
+func (w *rawWriter) writeRawInt16(i int64) error {
+	return w.write([]byte{
+		byte((i >> 8) & 0xff),
+		byte(i & 0xff)})
+}
+
+func (w *rawWriter) writeRawInt24(i int64) error {
+	return w.write([]byte{
 		byte((i >> 16) & 0xff),
 		byte((i >> 8) & 0xff),
 		byte(i & 0xff),
 	})
-	if err != nil {
-		w.err = err
-		return err
-	}
-
-	w.count += n
-	return nil
 }
 
-func (w *rawWriter) writeRawInt32(i int) error {
-	n, err := w.bw.Write([]byte{
+func (w *rawWriter) writeRawInt32(i int64) error {
+	return w.write([]byte{
 		byte((i >> 24) & 0xff),
 		byte((i >> 16) & 0xff),
 		byte((i >> 8) & 0xff),
 		byte(i & 0xff),
 	})
-	if err != nil {
-		w.err = err
-		return err
-	}
-
-	w.count += n
-	return nil
 }
 
-func (w *rawWriter) writeRawInt40(i int) error {
-	n, err := w.bw.Write([]byte{
+func (w *rawWriter) writeRawInt40(i int64) error {
+	return w.write([]byte{
 		byte((i >> 32) & 0xff),
 		byte((i >> 24) & 0xff),
 		byte((i >> 16) & 0xff),
 		byte((i >> 8) & 0xff),
 		byte(i & 0xff),
 	})
-	if err != nil {
-		w.err = err
-		return err
-	}
-
-	w.count += n
-	return nil
 }
 
-func (w *rawWriter) writeRawInt48(i int) error {
-	n, err := w.bw.Write([]byte{
+func (w *rawWriter) writeRawInt48(i int64) error {
+	return w.write([]byte{
 		byte((i >> 40) & 0xff),
 		byte((i >> 32) & 0xff),
 		byte((i >> 24) & 0xff),
@@ -101,17 +135,10 @@ func (w *rawWriter) writeRawInt48(i int) error {
 		byte((i >> 8) & 0xff),
 		byte(i & 0xff),
 	})
-	if err != nil {
-		w.err = err
-		return err
-	}
-
-	w.count += n
-	return nil
 }
 
-func (w *rawWriter) writeRawInt64(i int) error {
-	n, err := w.bw.Write([]byte{
+func (w *rawWriter) writeRawInt64(i int64) error {
+	return w.write([]byte{
 		byte((i >> 56) & 0xff),
 		byte((i >> 48) & 0xff),
 		byte((i >> 40) & 0xff),
@@ -121,73 +148,124 @@ func (w *rawWriter) writeRawInt64(i int) error {
 		byte((i >> 8) & 0xff),
 		byte(i & 0xff),
 	})
-	if err != nil {
-		w.err = err
-		return err
-	}
-
-	w.count += n
-	return nil
 }
 
 func (w *rawWriter) writeRawFloat32(f float32) error {
-	err := binary.Write(w.bw, binary.BigEndian, f)
-	if err != nil {
-		w.err = err
-		return err
-	}
-
-	return nil
+	bs := make([]byte, 4)
+	binary.BigEndian.PutUint32(bs, math.Float32bits(f))
+	return w.write(bs)
 }
 
 func (w *rawWriter) writeRawFloat64(f float64) error {
-	err := binary.Write(w.bw, binary.BigEndian, f)
-	if err != nil {
-		w.err = err
-		return err
-	}
-
-	return nil
+	bs := make([]byte, 8)
+	binary.BigEndian.PutUint64(bs, math.Float64bits(f))
+	return w.write(bs)
 }
 
 func (w *rawWriter) writeRawBytes(bytes []byte, offset int, length int) error {
-	n, err := w.bw.Write(bytes[offset : offset+length])
-	if err != nil {
-		w.err = err
-		return err
-	}
-
-	w.count += n
-	return nil
+	return w.write(bytes[offset : offset+length])
 }
 
 func (w *rawWriter) reset() {
 	w.count = 0
-	//w.err = nil
-	// TODO: reset checksum
+	w.checksum.Reset()
 }
 
 type Writer struct {
-	raw              *rawWriter
-	priorityCache    map[interface{}]int
-	priorityCacheIdx int
-	structCache      map[interface{}]int
-	structCacheIdx   int
-	handler          WriteHandler
+	raw           *rawWriter
+	priorityCache *writeCache
+	structCache   *writeCache
+	handlers      *WriteHandlers
+	autoCache     *autoCacher
+	dictionary    *Dictionary
+	cacheLimit    cacheLimit
+	cacheBytes    int
+	depth         int
+	openList      bool
+	closedLists   int
+	split         split
+	segment       segment
+	boundaries    []int64
+	sharing       bool
+	shared        map[identity]int
+	repeated      map[identity]bool
+	visiting      map[identity]bool
+	path          []pathElem
+	timeRounding  TimeRounding
+	java          bool
+	canonical     bool
+	frames        []frame
+	footer        bool
+	closed        bool
+	closeErr      error
+	// the open BytesWriter or StringWriter, if any
+	chunks io.WriteCloser
+}
+
+// pathElem is an element of the path to the value being written: an
+// index into a list, or a map key.
+type pathElem struct {
+	index int
+	key   interface{}
+	kind  pathKind
+}
+
+type pathKind byte
+
+const (
+	pathIndex pathKind = iota
+	pathMapValue
+	pathMapKey
+)
+
+// segment keeps track of the current segment of a split open list.
+type segment struct {
+	start   int64
+	records int
 }
 
-func NewWriter(w io.Writer, handler WriteHandler) *Writer {
-	if handler == nil {
-		handler = DefaultHandler
+// NewWriter creates a new Writer.
+//
+// Values are written using the registry given using WithWriteHandlers,
+// and those it has no handler for using handler.  If handler is nil,
+// they are written using DefaultHandler.
+func NewWriter(w io.Writer, handler WriteHandler, opts ...Option) *Writer {
+	var registry *WriteHandlers
+	if handler != nil {
+		registry = NewWriteHandlers(newOptions(opts).writeHandlers).SetDefault(handler)
 	}
-	return &Writer{
-		newRawWriter(w),
-		make(map[interface{}]int, 16), // TODO: fix these numbers
-		0,
-		make(map[interface{}]int, 16),
-		0,
-		handler,
+	return newWriterWith(w, registry, opts)
+}
+
+// newWriterWith creates a Writer that uses handlers, or the registry
+// given using WithWriteHandlers if handlers is nil.
+func newWriterWith(w io.Writer, handlers *WriteHandlers, opts []Option) *Writer {
+	o := newOptions(opts)
+	if handlers == nil {
+		handlers = o.writeHandlers
+	}
+	if handlers == nil {
+		handlers = defaultWriteHandlers
+	}
+	if o.autoCache != nil {
+		o.cacheLimit = o.autoCache.limit(o.cacheLimit)
+	}
+	wr := &Writer{
+		raw:          newRawWriter(w),
+		handlers:     handlers,
+		autoCache:    newAutoCacher(o.autoCache),
+		dictionary:   o.dictionary,
+		cacheLimit:   o.cacheLimit,
+		split:        o.split,
+		sharing:      o.sharing,
+		timeRounding: o.timeRounding,
+		java:         o.java,
+		canonical:    o.canonical,
+		footer:       o.footer,
+		visiting:     make(map[identity]bool),
 	}
+	wr.clearCaches()
+	return wr
 }
 
 type GzipWriter struct {
@@ -195,15 +273,23 @@ type GzipWriter struct {
 	gzipWriter *gzip.Writer
 }
 
-func NewGzipWriter(w io.Writer, handler WriteHandler) *GzipWriter {
+// NewGzipWriter creates a Writer that compresses its output using
+// gzip.  Close it to write the end of the gzip stream.
+//
+// With WithSplit, the segments are split within the uncompressed
+// stream, and Boundaries returns offsets into it.
+func NewGzipWriter(w io.Writer, handler WriteHandler, opts ...Option) *GzipWriter {
 	gzipWriter := gzip.NewWriter(w)
 	return &GzipWriter{
-		NewWriter(gzipWriter, handler),
+		NewWriter(gzipWriter, handler, opts...),
 		gzipWriter,
 	}
 }
 
 func (w *Writer) WriteNil() error {
+	w.beginValue()
+	defer w.endValue()
+
 	return w.writeCode(NULL)
 }
 
@@ -212,6 +298,9 @@ func (w *Writer) writeCode(code int) error {
 }
 
 func (w *Writer) WriteBool(b bool) error {
+	w.beginValue()
+	defer w.endValue()
+
 	if b {
 		return w.writeCode(TRUE)
 	} else {
@@ -220,31 +309,103 @@ func (w *Writer) WriteBool(b bool) error {
 }
 
 func (w *Writer) WriteInt(i int) error {
+	w.beginValue()
+	defer w.endValue()
+
+	return w.internalWriteInt(int64(i))
+}
+
+func (w *Writer) WriteInt64(i int64) error {
+	w.beginValue()
+	defer w.endValue()
+
 	return w.internalWriteInt(i)
 }
 
+// writeUint64 writes u as an int, or as a BIGINT if it is too big for
+// a long.
+func (w *Writer) writeUint64(u uint64) error {
+	if u <= math.MaxInt64 {
+		return w.WriteInt64(int64(u))
+	}
+
+	w.beginValue()
+	defer w.endValue()
+
+	w.writeCode(BIGINT)
+	return w.WriteBytes(bigIntBytes(new(big.Int).SetUint64(u)))
+}
+
+// writeTime writes t as the number of milliseconds since the epoch,
+// rounded according to the writer's TimeRounding.
+func (w *Writer) writeTime(t time.Time) error {
+	// Nanosecond is never negative, so this rounds towards the past
+	millis := t.Unix()*1000 + int64(t.Nanosecond()/1e6)
+	if rest := t.Nanosecond() % 1e6; rest != 0 {
+		switch w.timeRounding {
+		case RoundTime:
+			if rest >= 5e5 {
+				millis++
+			}
+		case RejectSubMillisecond:
+			return w.fail(fmt.Errorf("time %v has sub-millisecond precision", t))
+		}
+	}
+
+	w.writeCode(INST)
+	return w.WriteInt64(millis)
+}
+
 func (w *Writer) WriteFloat32(f float32) error {
+	w.beginValue()
+	defer w.endValue()
+
+	if w.canonical {
+		f = canonicalFloat32(f)
+	}
+	w.writeCode(FLOAT)
 	return w.raw.writeRawFloat32(f)
 }
 
 func (w *Writer) WriteFloat64(f float64) error {
+	w.beginValue()
+	defer w.endValue()
+
+	if f == 0.0 {
+		return w.writeCode(DOUBLE_0)
+	} else if f == 1.0 {
+		return w.writeCode(DOUBLE_1)
+	}
+
+	if w.canonical {
+		f = canonicalFloat64(f)
+	}
+	w.writeCode(DOUBLE)
 	return w.raw.writeRawFloat64(f)
 }
 
+// WriteString writes s like Java's FressianWriter, which encodes the
+// UTF-16 chars of strings like UTF-8.  Supplementary characters are
+// thus written as two 3-byte surrogates (CESU-8), and long strings are
+// split into chunks between chars.
 func (w *Writer) WriteString(s string) error {
+	w.beginValue()
+	defer w.endValue()
+
+	chars := utf16.Encode([]rune(s))
 	stringPos := 0
 	bufPos := 0
 	bufSize := STRING_CHUNK_MAX_SIZE
-	if len(s) < bufSize {
-		bufSize = len(s)
+	if len(chars)*3 < bufSize {
+		bufSize = len(chars) * 3
 	}
 	buf := make([]byte, bufSize)
 
 	for {
-		stringPos, bufPos = encodeToBuffer(s, stringPos, buf)
+		stringPos, bufPos = encodeToBuffer(chars, stringPos, buf)
 		if bufPos < STRING_PACKED_MAX_SIZE {
 			w.raw.writeRawByte(STRING_PACKED_LENGTH_START + byte(bufPos))
-		} else if stringPos == len(s) {
+		} else if stringPos == len(chars) {
 			w.writeCode(STRING)
 			w.writeCount(bufPos)
 		} else {
@@ -253,7 +414,7 @@ func (w *Writer) WriteString(s string) error {
 		}
 		w.raw.writeRawBytes(buf, 0, bufPos)
 
-		if stringPos >= len(s) {
+		if stringPos >= len(chars) {
 			break
 		}
 	}
@@ -261,39 +422,158 @@ func (w *Writer) WriteString(s string) error {
 	return w.raw.err
 }
 
-// put as many (full) runes into buf as possible.  assumes s contains
-// only valid runes.
-func encodeToBuffer(s string, start int, buf []byte) (int, int) {
+// put as many chars into buf as possible, each encoded in 1 to 3 bytes.
+func encodeToBuffer(chars []uint16, start int, buf []byte) (int, int) {
 	bufPos := 0
 	stringPos := start
-	for _, ch := range s[start:] {
-		encodedSize := utf8.RuneLen(ch)
+	for ; stringPos < len(chars); stringPos++ {
+		ch := chars[stringPos]
+		encodedSize := 3
+		if ch <= 0x7f {
+			encodedSize = 1
+		} else if ch <= 0x7ff {
+			encodedSize = 2
+		}
 		if bufPos+encodedSize > len(buf) {
 			break
 		}
 
-		utf8.EncodeRune(buf[bufPos:], ch)
+		switch encodedSize {
+		case 1:
+			buf[bufPos] = byte(ch)
+		case 2:
+			buf[bufPos] = 0xc0 | byte(ch>>6)
+			buf[bufPos+1] = 0x80 | byte(ch&0x3f)
+		case 3:
+			buf[bufPos] = 0xe0 | byte(ch>>12)
+			buf[bufPos+1] = 0x80 | byte((ch>>6)&0x3f)
+			buf[bufPos+2] = 0x80 | byte(ch&0x3f)
+		}
 		bufPos += encodedSize
-		stringPos += encodedSize
 	}
 
 	return stringPos, bufPos
 }
 
 func (w *Writer) WriteList(l []interface{}) error {
+	w.beginValue()
+	defer w.endValue()
+
 	if l == nil {
 		return w.WriteNil()
 	}
 
-	length := len(l)
+	w.writeListHeader(len(l))
+	return w.writeElements(l)
+}
+
+// writeElements writes vals, keeping track of their indices in the
+// path of the value being written.
+func (w *Writer) writeElements(vals []interface{}) error {
+	w.path = append(w.path, pathElem{})
+	defer w.popPath()
+
+	elem := &w.path[len(w.path)-1]
+	for i, val := range vals {
+		elem.index = i
+		if err := w.WriteValue(val); err != nil {
+			return err
+		}
+	}
+	return w.raw.err
+}
+
+func (w *Writer) popPath() {
+	w.path = w.path[:len(w.path)-1]
+}
+
+// formatPath formats the path of the value being written, e.g. as
+// [3][:name].
+func (w *Writer) formatPath() string {
+	var b strings.Builder
+	for _, elem := range w.path {
+		switch elem.kind {
+		case pathIndex:
+			fmt.Fprintf(&b, "[%d]", elem.index)
+		case pathMapValue:
+			fmt.Fprintf(&b, "[%v]", elem.key)
+		case pathMapKey:
+			fmt.Fprintf(&b, "{%v}", elem.key)
+		}
+	}
+	return b.String()
+}
+
+func (w *Writer) writeListHeader(length int) error {
 	if length < LIST_PACKED_MAX_SIZE {
-		w.raw.writeRawByte(byte(LIST_PACKED_LENGTH_START + length))
-	} else {
-		w.writeCode(LIST)
-		w.writeCount(length)
+		return w.raw.writeRawByte(byte(LIST_PACKED_LENGTH_START + length))
 	}
-	for _, o := range l {
-		w.WriteValue(o)
+	w.writeCode(LIST)
+	return w.writeCount(length)
+}
+
+// writeMap writes the entries of m, which must be a map, as a MAP.
+func (w *Writer) writeMap(m reflect.Value) error {
+	w.writeCode(MAP)
+
+	w.beginValue()
+	defer w.endValue()
+
+	w.writeListHeader(m.Len() * 2)
+	w.path = append(w.path, pathElem{})
+	defer w.popPath()
+
+	elem := &w.path[len(w.path)-1]
+	writeEntry := func(key, val reflect.Value) error {
+		k := key.Interface()
+		elem.key, elem.kind = k, pathMapKey
+		if err := w.WriteValue(k); err != nil {
+			return err
+		}
+		elem.kind = pathMapValue
+		return w.WriteValue(val.Interface())
+	}
+
+	if w.canonical {
+		for _, e := range w.sortedEntries(m) {
+			if err := writeEntry(e.key, e.val); err != nil {
+				return err
+			}
+		}
+		return w.raw.err
+	}
+
+	iter := m.MapRange()
+	for iter.Next() {
+		if err := writeEntry(iter.Key(), iter.Value()); err != nil {
+			return err
+		}
+	}
+	return w.raw.err
+}
+
+// writeSet writes the elements of s, sorted like the keys of maps in
+// canonical mode.
+func (w *Writer) writeSet(s Set) error {
+	w.writeCode(SET)
+
+	w.beginValue()
+	defer w.endValue()
+
+	w.writeListHeader(len(s))
+	if w.canonical {
+		for _, e := range w.sortedEntries(reflect.ValueOf(s)) {
+			if err := w.WriteValue(e.key.Interface()); err != nil {
+				return err
+			}
+		}
+		return w.raw.err
+	}
+
+	for elem := range s {
+		if err := w.WriteValue(elem); err != nil {
+			return err
+		}
 	}
 	return w.raw.err
 }
@@ -307,6 +587,9 @@ func (w *Writer) WriteBytes(bytes []byte) error {
 }
 
 func (w *Writer) WriteBytes_(bytes []byte, offset int, length int) error {
+	w.beginValue()
+	defer w.endValue()
+
 	if length < BYTES_PACKED_MAX_SIZE {
 		w.raw.writeRawByte(byte(BYTES_PACKED_LENGTH_START + length))
 		w.raw.writeRawBytes(bytes, offset, length)
@@ -327,43 +610,15 @@ func (w *Writer) WriteBytes_(bytes []byte, offset int, length int) error {
 }
 
 func (w *Writer) writeCount(c int) error {
-	return w.WriteInt(c)
+	return w.internalWriteInt(int64(c))
 }
 
 // c.f. java.lang.Long#numberOfLeadingZeros
-func numberOfLeadingZeros(i int) int {
-	if i == 0 {
-		return 64
-	}
-
-	n := 1
-	x := i >> 32
-	if x == 0 {
-		n += 32
-		x = i
-	}
-	if x>>16 == 0 {
-		n += 16
-		x <<= 16
-	}
-	if x>>24 == 0 {
-		n += 8
-		x <<= 8
-	}
-	if x>>28 == 0 {
-		n += 4
-		x <<= 4
-	}
-	if x>>30 == 0 {
-		n += 2
-		x <<= 2
-	}
-	n -= x >> 31
-
-	return n
+func numberOfLeadingZeros(i int64) int {
+	return bits.LeadingZeros64(uint64(i))
 }
 
-func bitSwitch(i int) int {
+func bitSwitch(i int64) int {
 	if i < 0 {
 		i = ^i
 	}
@@ -371,7 +626,7 @@ func bitSwitch(i int) int {
 	return numberOfLeadingZeros(i)
 }
 
-func (w *Writer) internalWriteInt(i int) error {
+func (w *Writer) internalWriteInt(i int64) error {
 	switch bitSwitch(i) {
 	case 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14:
 		w.writeCode(INT)
@@ -400,19 +655,112 @@ func (w *Writer) internalWriteInt(i int) error {
 		}
 		return w.raw.writeRawByte(byte(i))
 	default:
-		log.Fatal("int too big: ", i)
+		return w.fail(fmt.Errorf("int too big: %d", i))
+	}
+}
+
+// beginValue must be called before a value is written, and endValue
+// afterwards.  Values started at depth 0 are top-level values, or
+// elements of a list started with BeginClosedList or BeginOpenList.
+func (w *Writer) beginValue() {
+	w.checkChunks()
+	w.countElement()
+	if w.depth == 0 {
+		w.valueBoundary()
+	}
+	w.depth++
+}
+
+func (w *Writer) endValue() {
+	w.depth--
+}
+
+// checkChunks makes writing fail if a BytesWriter or StringWriter is
+// open, because its chunks would be mixed with the other output.
+func (w *Writer) checkChunks() error {
+	switch w.chunks.(type) {
+	case nil:
 		return nil
+	case *bytesWriter:
+		return w.fail(errBytesWriterOpen)
+	default:
+		return w.fail(errStringWriterOpen)
+	}
+}
+
+// valueBoundary is called before a top-level value is written.
+func (w *Writer) valueBoundary() {
+	// values are only shared within a top-level value, because the
+	// ones written before may have changed or been freed since
+	for id := range w.shared {
+		delete(w.shared, id)
+	}
+	if w.openList && w.closedLists == 0 && w.split.enabled() {
+		w.recordBoundary()
+	}
+	if w.cacheLimit.exceeded(w.cacheEntries(), w.cacheBytes) {
+		w.ResetCaches()
+	}
+}
+
+// recordBoundary is called before an element of a split open list is
+// written, and starts a new segment if the current one is full.
+func (w *Writer) recordBoundary() {
+	if w.boundaries == nil {
+		w.boundaries = append(w.boundaries, w.raw.offset)
+		w.segment = segment{w.raw.offset, 0}
+	} else if w.split.full(w.segment.records, w.raw.offset-w.segment.start) {
+		if w.split.footer {
+			w.WriteFooter()
+		}
+		w.boundaries = append(w.boundaries, w.raw.offset)
+		w.segment = segment{w.raw.offset, 0}
+		w.ResetCaches()
+	}
+	w.segment.records++
+}
+
+// Boundaries returns the offsets at which the segments of a split open
+// list start, see WithSplit.  The offsets count the bytes the Writer
+// wrote, before any compression: for a GzipWriter they are offsets into
+// the uncompressed stream, not into the gzip output.
+func (w *Writer) Boundaries() []int64 {
+	return w.boundaries
+}
+
+// cacheEntries returns the number of entries in the caches that are
+// not part of the dictionary.
+func (w *Writer) cacheEntries() int {
+	n := w.priorityCache.len() + w.structCache.len()
+	if w.dictionary != nil {
+		n -= len(w.dictionary.Values) + len(w.dictionary.Structs)
 	}
+	return n
 }
 
+// clearCaches empties the caches, or resets them to the dictionary
+// if there is one.
 func (w *Writer) clearCaches() {
-	w.priorityCache = make(map[interface{}]int, 16)
-	w.priorityCacheIdx = 0
-	w.structCache = make(map[interface{}]int, 16)
-	w.structCacheIdx = 0
+	w.priorityCache = newWriteCache()
+	w.structCache = newWriteCache()
+	w.cacheBytes = 0
+	if w.sharing {
+		w.shared = make(map[identity]int)
+	}
+	if w.dictionary != nil {
+		for _, val := range w.dictionary.Values {
+			w.priorityCache.add(val)
+		}
+		for _, st := range w.dictionary.Structs {
+			w.structCache.add(structKey{st.Tag, st.Fields})
+		}
+	}
 }
 
 func (w *Writer) ResetCaches() error {
+	if err := w.checkChunks(); err != nil {
+		return err
+	}
 	w.clearCaches()
 	return w.writeCode(RESET_CACHES)
 }
@@ -436,18 +784,34 @@ var tagToCode = map[interface{}]int{
 "Object[]":  OBJECT_ARRAY,*/
 }
 
+// structKey is the key of a struct type in the struct cache.
+type structKey struct {
+	tag    interface{}
+	fields int
+}
+
 func (w *Writer) writeTag(tag interface{}, componentCount int) error {
 	shortcutCode, ok := tagToCode[tag]
 	if ok {
 		return w.writeCode(shortcutCode)
+	} else if w.canonical {
+		// the bytes of a struct don't depend on the ones before it
+		w.writeCode(STRUCTTYPE)
+		w.WriteValue(tag)
+		return w.WriteInt(componentCount)
 	} else {
-		idx, ok := w.structCache[tag]
+		// a struct type is its tag and its number of fields, a cached
+		// type with another number of fields can't be used
+		key := structKey{tag, componentCount}
+		idx, ok := w.structCache.index(key)
 		if !ok {
-			w.structCache[tag] = w.structCacheIdx
-			w.structCacheIdx += 1
+			start := w.raw.count
+			w.structCache.add(key)
 			w.writeCode(STRUCTTYPE)
 			w.WriteValue(tag)
-			return w.WriteInt(componentCount)
+			err := w.WriteInt(componentCount)
+			w.cacheBytes += w.raw.count - start
+			return err
 		} else if idx < STRUCT_CACHE_MAX_SIZE {
 			return w.writeCode(STRUCT_CACHE_PACKED_START + idx)
 		} else {
@@ -458,11 +822,11 @@ func (w *Writer) writeTag(tag interface{}, componentCount int) error {
 }
 
 func (w *Writer) WriteExt(tag interface{}, fields ...interface{}) error {
+	w.beginValue()
+	defer w.endValue()
+
 	w.writeTag(tag, len(fields))
-	for _, field := range fields {
-		w.WriteValue(field)
-	}
-	return w.raw.err
+	return w.writeElements(fields)
 }
 
 func shouldSkipCache(val interface{}) bool {
@@ -474,6 +838,8 @@ func shouldSkipCache(val interface{}) bool {
 	case bool:
 		return true
 	case int:
+		return shouldSkipCache(int64(val))
+	case int64:
 		switch bitSwitch(val) {
 		case 52, 53, 54, 55, 56, 57, 58, 59, 60, 61, 62, 63, 64:
 			return true
@@ -494,27 +860,79 @@ func (w *Writer) doWrite(tag string, val interface{}, wh WriteHandler, cache boo
 		if shouldSkipCache(val) {
 			return w.doWrite(tag, val, wh, false)
 		} else {
-			idx, ok := w.priorityCache[val]
+			idx, ok := w.priorityCache.index(val)
 			if !ok {
-				w.priorityCache[tag] = w.priorityCacheIdx
-				w.priorityCacheIdx += 1
+				start := w.raw.count
+				w.priorityCache.add(val)
 				w.writeCode(PUT_PRIORITY_CACHE)
-				return w.doWrite(tag, val, wh, false)
-			} else if idx < PRIORITY_CACHE_PACKED_END {
-				return w.writeCode(PRIORITY_CACHE_PACKED_START + idx)
+				err := w.doWrite(tag, val, wh, false)
+				w.cacheBytes += w.raw.count - start
+				return err
 			} else {
-				w.writeCode(GET_PRIORITY_CACHE)
-				return w.WriteInt(idx)
+				return w.writePriorityRef(idx)
 			}
 		}
-	} else {
-		return wh(w, val)
+	} else if err := wh(w, val); err != nil {
+		if w.raw.err == nil {
+			// the error happened here, not in a nested value
+			err = withErrorPath(err, w.formatPath())
+		}
+		return w.fail(err)
+	}
+	return w.raw.err
+}
+
+// withErrorPath adds path to errors that have one.
+func withErrorPath(err error, path string) error {
+	switch e := err.(type) {
+	case *conversionError:
+		if path != "" {
+			return &PathError{path, err}
+		}
+	case *CycleError:
+		if e.Path == "" {
+			e.Path = path
+		}
+	}
+	return err
+}
+
+// fail makes err the error of the writer, unless writing failed
+// before, and returns the error of the writer.  Once writing failed,
+// nothing is written anymore.
+func (w *Writer) fail(err error) error {
+	if w.raw.err == nil {
+		w.raw.err = err
+	}
+	return w.raw.err
+}
+
+// writePriorityRef writes a reference to entry idx of the priority
+// cache.
+func (w *Writer) writePriorityRef(idx int) error {
+	if idx < PRIORITY_CACHE_MAX_SIZE {
+		return w.writeCode(PRIORITY_CACHE_PACKED_START + idx)
 	}
+	w.writeCode(GET_PRIORITY_CACHE)
+	return w.WriteInt(idx)
 }
 
 func (w *Writer) WriteAs(tag string, val interface{}, cache bool) error {
-	// TODO: lookup handler
-	return w.doWrite(tag, val, w.handler, cache)
+	w.beginValue()
+	defer w.endValue()
+
+	if w.sharing && w.repeated == nil {
+		w.repeated = findRepeated(val)
+		defer func() { w.repeated = nil }()
+	}
+	if w.canonical {
+		cache = false
+	}
+	if s, ok := val.(string); ok && !cache && w.autoCache != nil && len(s) <= w.autoCache.MaxStringLength {
+		_, cached := w.priorityCache.index(s)
+		cache = w.autoCache.cacheString(s, cached)
+	}
+	return w.doWrite(tag, val, w.handlers.Lookup(tag, val), cache)
 }
 
 // WriteAny or even Write?
@@ -523,30 +941,129 @@ func (w *Writer) WriteValue(val interface{}) error {
 	return w.WriteAs("", val, false)
 }
 
+// WriteRecord writes val like WriteValue, but only if it can be
+// written completely.  If writing it fails, neither its bytes nor the
+// cache entries it added are kept, so that the stream stays readable
+// and further values can be written.
+//
+// Like ResetCaches, WriteRecord must not be called while writing
+// another value.
+func (w *Writer) WriteRecord(val interface{}) error {
+	return w.writeRecord(func() error {
+		return w.WriteValue(val)
+	})
+}
+
+// writeRecord calls write, and keeps what it wrote only if it
+// succeeds.
+func (w *Writer) writeRecord(write func() error) error {
+	if w.depth > 0 {
+		return errors.New("WriteRecord called while writing a value")
+	}
+	if err := w.raw.err; err != nil {
+		return err
+	}
+
+	w.valueBoundary()
+	if err := w.raw.err; err != nil {
+		return err
+	}
+	w.depth++
+	defer w.endValue()
+
+	priority, structs, cacheBytes := w.priorityCache.len(), w.structCache.len(), w.cacheBytes
+	frames, closedLists, openList := len(w.frames), w.closedLists, w.openList
+	w.raw.stage()
+	if err := write(); err != nil {
+		w.raw.rollback()
+		w.path = w.path[:0]
+		w.priorityCache.truncate(priority)
+		w.structCache.truncate(structs)
+		for id, idx := range w.shared {
+			if idx >= priority {
+				delete(w.shared, id)
+			}
+		}
+		w.cacheBytes = cacheBytes
+		// collections that were started but not ended are gone
+		w.frames = w.frames[:frames]
+		w.closedLists, w.openList = closedLists, openList
+		w.depth = 1
+		// and so is a BytesWriter or StringWriter left open
+		w.discardChunks()
+		return err
+	}
+	return w.raw.commit()
+}
+
 func (w *Writer) BeginClosedList() error {
+	w.beginValue()
+	defer w.endValue()
+
+	w.closedLists++
+	w.frames = append(w.frames, frame{frameClosedList, w.depth - 1, -1, 0})
 	return w.writeCode(BEGIN_CLOSED_LIST)
 }
 
 func (w *Writer) EndList() error {
+	if n := len(w.frames); n > 0 && w.frames[n-1].kind != frameClosedList {
+		return fmt.Errorf("EndList called for a %s, use End", w.frames[n-1].kind)
+	}
+	if err := w.checkChunks(); err != nil {
+		return err
+	}
+
+	if w.closedLists > 0 {
+		w.closedLists--
+		w.frames = w.frames[:len(w.frames)-1]
+	} else {
+		w.openList = false
+	}
 	return w.writeCode(END_COLLECTION)
 }
 
 func (w *Writer) BeginOpenList() error {
+	if err := w.checkChunks(); err != nil {
+		return err
+	}
 	if w.raw.count != 0 {
 		return errors.New("open list must be called from the top level, outside any footer context")
 	}
 
 	err := w.writeCode(BEGIN_OPEN_LIST)
 	w.raw.reset()
+	w.openList = true
 	return err
 }
 
+// WriteFooter writes a footer containing the number of bytes written
+// since the start of the stream, or since the previous footer, and
+// their checksum.  Readers verify the footer and reset their caches.
+func (w *Writer) WriteFooter() error {
+	if err := w.checkChunks(); err != nil {
+		return err
+	}
+	length := w.raw.count
+	w.raw.writeRawInt32(FOOTER_MAGIC)
+	w.raw.writeRawInt32(int64(length))
+	w.raw.writeRawInt32(int64(w.raw.checksum.Sum32()))
+	w.raw.reset()
+	w.clearCaches()
+	return w.raw.err
+}
+
 func (w *Writer) Error() error {
 	return w.raw.err
 }
 
 func (w *Writer) Flush() error {
-	return w.raw.bw.Flush()
+	if w.raw.err != nil {
+		return w.raw.err
+	}
+	if err := w.raw.bw.Flush(); err != nil {
+		return w.fail(err)
+	}
+	return nil
 }
 
 func (w *GzipWriter) Flush() error {
@@ -554,5 +1071,62 @@ func (w *GzipWriter) Flush() error {
 	if err != nil {
 		return err
 	}
-	return w.gzipWriter.Flush()
+	if err := w.gzipWriter.Flush(); err != nil {
+		return w.fail(err)
+	}
+	return nil
+}
+
+// Close ends the lists started with BeginClosedList or BeginOpenList
+// that are still open, writes a footer if WithFooter was given, and
+// flushes the buffered output.  It returns the first error that
+// occurred while writing, and fails if a value is still being written,
+// e.g. a collection started with BeginList.  Nothing can be written
+// after Close, calling it again returns the same error.
+//
+// Close doesn't close the underlying io.Writer.
+func (w *Writer) Close() error {
+	if w.closed {
+		return w.closeErr
+	}
+	w.closed = true
+	w.closeErr = w.finish()
+	w.fail(errWriteAfterClose)
+	return w.closeErr
+}
+
+func (w *Writer) finish() error {
+	if err := w.checkChunks(); err != nil {
+		return err
+	}
+	if w.depth > 0 {
+		if n := len(w.frames); n > 0 && w.frames[n-1].kind != frameClosedList {
+			return w.fail(fmt.Errorf("Close called with an open %s", w.frames[n-1].kind))
+		}
+		return w.fail(errors.New("Close called while writing a value"))
+	}
+
+	for w.closedLists > 0 {
+		w.EndList()
+	}
+	if w.openList {
+		w.EndList()
+	}
+	if w.footer {
+		w.WriteFooter()
+	}
+	return w.Flush()
+}
+
+// Close closes the Writer like Writer.Close does, and then the gzip
+// stream, writing its trailer.
+//
+// If closing the Writer fails, e.g. because a value is still being
+// written, the gzip stream is left without its trailer, so that
+// reading it fails instead of returning an incomplete value.
+func (w *GzipWriter) Close() error {
+	if err := w.Writer.Close(); err != nil {
+		return err
+	}
+	return w.gzipWriter.Close()
 }
@@ -11,13 +11,186 @@ import (
 
 type WriteHandler func(w *Writer, val interface{}) error
 
+type writeHandlerEntry struct {
+	typ     reflect.Type
+	handler WriteHandler
+}
+
+// WriteHandlers is a registry of WriteHandlers, keyed by the type of
+// the values they write and by the tag they write them with.
+//
+// Values are looked up by their exact type first, then by the
+// interface types registered, in the order they were added.  Types
+// that neither a registry nor any of its parents has a handler for
+// are written using the default handler, which is DefaultHandler
+// unless set otherwise.
+type WriteHandlers struct {
+	types  map[reflect.Type]writeHandlerEntry
+	ifaces []writeHandlerEntry
+	tags   map[string]WriteHandler
+	parent *WriteHandlers
+	dflt   WriteHandler
+}
+
+var defaultWriteHandlers = NewWriteHandlers(nil)
+
+// NewWriteHandlers creates an empty registry that falls back to
+// parent, if parent is not nil.
+func NewWriteHandlers(parent *WriteHandlers) *WriteHandlers {
+	return &WriteHandlers{
+		make(map[reflect.Type]writeHandlerEntry),
+		nil,
+		make(map[string]WriteHandler),
+		parent,
+		nil,
+	}
+}
+
+// Add registers handler for values of type typ, which may be an
+// interface type.  If tag is not empty, the handler is also used for
+// values written using WriteAs with that tag.  It returns h so that
+// calls can be chained.
+func (h *WriteHandlers) Add(typ reflect.Type, tag string, handler WriteHandler) *WriteHandlers {
+	entry := writeHandlerEntry{typ, handler}
+	if typ.Kind() == reflect.Interface {
+		h.ifaces = append(h.ifaces, entry)
+	} else {
+		h.types[typ] = entry
+	}
+	if tag != "" {
+		h.tags[tag] = handler
+	}
+	return h
+}
+
+// SetDefault sets the handler used for values that have no handler
+// registered for their type.
+func (h *WriteHandlers) SetDefault(handler WriteHandler) *WriteHandlers {
+	h.dflt = handler
+	return h
+}
+
+// Lookup returns the handler for writing val with tag.
+func (h *WriteHandlers) Lookup(tag string, val interface{}) WriteHandler {
+	if tag != "" {
+		for wh := h; wh != nil; wh = wh.parent {
+			if handler, ok := wh.tags[tag]; ok {
+				return handler
+			}
+		}
+	}
+
+	if val != nil {
+		typ := reflect.TypeOf(val)
+		for wh := h; wh != nil; wh = wh.parent {
+			if entry, ok := wh.types[typ]; ok {
+				return entry.handler
+			}
+		}
+		for wh := h; wh != nil; wh = wh.parent {
+			for _, entry := range wh.ifaces {
+				if typ.Implements(entry.typ) {
+					return entry.handler
+				}
+			}
+		}
+	}
+
+	for wh := h; wh != nil; wh = wh.parent {
+		if wh.dflt != nil {
+			return wh.dflt
+		}
+	}
+
+	return DefaultHandler
+}
+
+// RegisterWriteHandler registers handler for values of type T, see
+// WriteHandlers.Add.
+func RegisterWriteHandler[T any](h *WriteHandlers, tag string, handler func(w *Writer, val T) error) *WriteHandlers {
+	typ := reflect.TypeOf((*T)(nil)).Elem()
+	return h.Add(typ, tag, func(w *Writer, val interface{}) error {
+		return handler(w, val.(T))
+	})
+}
+
+// ConversionError is returned when writing a value for which there is
+// no handler.  For a value nested in the one being written, it is
+// wrapped in a PathError.
 type ConversionError error
 
+// conversionError is the ConversionError DefaultHandler returns for
+// values it doesn't know how to write.
+type conversionError struct {
+	value interface{}
+}
+
+func (e *conversionError) Error() string {
+	return fmt.Sprintf("don't know how to convert '%v' (%T)", e.value, e.value)
+}
+
+// IsConversionError reports whether e is, or wraps, the error returned
+// for a value that can't be written.
 func IsConversionError(e error) bool {
-	_, ok := e.(ConversionError)
-	return ok
+	var ce *conversionError
+	return errors.As(e, &ce)
+}
+
+// PathError is returned when a value nested in the value being written
+// can't be converted.  Err is the ConversionError for it.
+type PathError struct {
+	// Path is the path from the top-level value to the value, e.g.
+	// [3][:name].
+	Path string
+	Err  error
+}
+
+func (e *PathError) Error() string {
+	return fmt.Sprintf("%s at %s", e.Err, e.Path)
 }
 
+func (e *PathError) Unwrap() error {
+	return e.Err
+}
+
+// bigIntBytes returns the two's complement of i, in as few bytes as
+// possible, like Java's BigInteger#toByteArray.
+func bigIntBytes(i *big.Int) []byte {
+	if i.Sign() >= 0 {
+		bs := i.Bytes()
+		if len(bs) == 0 || bs[0]&0x80 != 0 {
+			// a leading zero byte keeps it positive
+			bs = append([]byte{0}, bs...)
+		}
+		return bs
+	}
+
+	// the two's complement of -x is the complement of x - 1
+	x := new(big.Int).Neg(i)
+	bs := x.Sub(x, big.NewInt(1)).Bytes()
+	for k := range bs {
+		bs[k] = ^bs[k]
+	}
+	if len(bs) == 0 || bs[0]&0x80 == 0 {
+		bs = append([]byte{0xff}, bs...)
+	}
+	return bs
+}
+
+// namespace returns the namespace of a keyword or symbol as it is
+// written.
+func (w *Writer) namespace(ns string) interface{} {
+	if ns == "" && w.java {
+		// Clojure's keywords and symbols have a nil namespace instead
+		return nil
+	}
+	return ns
+}
+
+// DefaultHandler writes the values fressian has a representation for.
+//
+// []int is written as a long array, because int may be 64 bits wide,
+// and is read back as []int64.
 func DefaultHandler(w *Writer, val interface{}) error {
 	if val == nil {
 		return w.WriteNil()
@@ -28,6 +201,26 @@ func DefaultHandler(w *Writer, val interface{}) error {
 		return w.WriteBool(val)
 	case int:
 		return w.WriteInt(val)
+	case int8:
+		return w.WriteInt(int(val))
+	case int16:
+		return w.WriteInt(int(val))
+	case int32:
+		return w.WriteInt(int(val))
+	case int64:
+		return w.WriteInt64(val)
+	case uint8:
+		return w.WriteInt(int(val))
+	case uint16:
+		return w.WriteInt(int(val))
+	case uint32:
+		return w.WriteInt64(int64(val))
+	case uint:
+		return w.writeUint64(uint64(val))
+	case uint64:
+		return w.writeUint64(val)
+	case uintptr:
+		return w.writeUint64(uint64(val))
 	case float32:
 		return w.WriteFloat32(val)
 	case float64:
@@ -35,68 +228,132 @@ func DefaultHandler(w *Writer, val interface{}) error {
 	case string:
 		return w.WriteString(val)
 	case Keyword:
+		cache := w.autoCache != nil && w.autoCache.Keywords
 		w.writeCode(KEY)
-		w.WriteValue(val.Namespace)
-		return w.WriteValue(val.Name)
+		w.WriteAs("", w.namespace(val.Namespace), cache)
+		return w.WriteAs("", val.Name, cache)
+	case Symbol:
+		cache := w.autoCache != nil && w.autoCache.Symbols
+		w.writeCode(SYM)
+		w.WriteAs("", w.namespace(val.Namespace), cache)
+		return w.WriteAs("", val.Name, cache)
 	case UUID:
 		w.writeCode(CODE_UUID)
 		return w.WriteBytes(val.Bytes())
 	case time.Time:
-		w.writeCode(INST)
-		return w.WriteInt(int(val.Unix() * 1000))
+		return w.writeTime(val)
 	case *url.URL:
 		w.writeCode(URI)
 		return w.WriteString(val.String())
+	case *big.Int:
+		if val == nil {
+			return w.WriteNil()
+		}
+		w.writeCode(BIGINT)
+		return w.WriteBytes(bigIntBytes(val))
 	case big.Int:
 		w.writeCode(BIGINT)
-		bs := val.Bytes()
-		if val.Sign() < 0 {
-			for i, _ := range bs {
-				bs[i] ^= 0xff
-			}
-			bs[len(bs)-1] -= 1
-		}
-		return w.WriteBytes_(bs, 0, len(bs))
+		return w.WriteBytes(bigIntBytes(&val))
 	case []bool:
 		w.writeCode(BOOLEAN_ARRAY)
 		w.writeCount(len(val))
 		for _, b := range val {
-			w.WriteBool(b)
+			if err := w.WriteBool(b); err != nil {
+				return err
+			}
 		}
 		return w.Error()
-	case []int:
+	case []int32:
 		w.writeCode(INT_ARRAY)
 		w.writeCount(len(val))
 		for _, i := range val {
-			w.WriteInt(i)
+			if err := w.WriteInt(int(i)); err != nil {
+				return err
+			}
 		}
 		return w.Error()
+	case []int64:
+		w.writeCode(LONG_ARRAY)
+		w.writeCount(len(val))
+		for _, i := range val {
+			if err := w.WriteInt64(i); err != nil {
+				return err
+			}
+		}
+		return w.Error()
+	case []int:
+		// int may be 64 bits wide, so it goes out as a long[]
+		w.writeCode(LONG_ARRAY)
+		w.writeCount(len(val))
+		for _, i := range val {
+			if err := w.WriteInt(i); err != nil {
+				return err
+			}
+		}
+		return w.Error()
+	case []float32:
+		w.writeCode(FLOAT_ARRAY)
+		w.writeCount(len(val))
+		for _, f := range val {
+			if err := w.WriteFloat32(f); err != nil {
+				return err
+			}
+		}
+		return w.Error()
+	case []float64:
+		w.writeCode(DOUBLE_ARRAY)
+		w.writeCount(len(val))
+		for _, f := range val {
+			if err := w.WriteFloat64(f); err != nil {
+				return err
+			}
+		}
+		return w.Error()
+	case ObjectArray:
+		return w.writeTracked(reflect.ValueOf(val), func() error {
+			w.writeCode(OBJECT_ARRAY)
+			w.writeCount(len(val))
+			return w.writeElements(val)
+		})
+	case StructAny:
+		return w.WriteExt(val.Tag, val.Values...)
+	case Set:
+		return w.writeSet(val)
 	case []byte:
 		return w.WriteBytes_(val, 0, len(val))
 	case []interface{}:
-		return w.WriteList(val)
+		return w.writeTracked(reflect.ValueOf(val), func() error {
+			return w.WriteList(val)
+		})
 	default:
-		switch reflect.TypeOf(val).Kind() {
+		v := reflect.ValueOf(val)
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return w.WriteInt64(v.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			return w.writeUint64(v.Uint())
 		case reflect.Slice:
-			// TODO: don't copy, write directly
-			val := reflect.ValueOf(val)
-			vals := make([]interface{}, val.Len())
-			for i := 0; i < val.Len(); i++ {
-				vals[i] = val.Index(i).Interface()
-			}
-			return w.WriteList(vals)
+			return w.writeTracked(v, func() error {
+				// TODO: don't copy, write directly
+				vals := make([]interface{}, v.Len())
+				for i := 0; i < v.Len(); i++ {
+					vals[i] = v.Index(i).Interface()
+				}
+				return w.WriteList(vals)
+			})
 		case reflect.Map:
-			val := reflect.ValueOf(val)
-			ks := val.MapKeys()
-			kvs := make([]interface{}, len(ks)*2)
-			for i, k := range ks {
-				kvs[i*2] = k.Interface()
-				kvs[i*2+1] = val.MapIndex(k).Interface()
+			return w.writeTracked(v, func() error {
+				return w.writeMap(v)
+			})
+		case reflect.Ptr:
+			if v.IsNil() {
+				return w.WriteNil()
 			}
-			w.writeCode(MAP)
-			return w.WriteList(kvs)
+			return w.writeTracked(v, func() error {
+				return w.WriteValue(v.Elem().Interface())
+			})
 		default:
-			return ConversionError(errors.New(fmt.Sprintf("don't know how to convert '%s'", val)))
+			return ConversionError(&conversionError{val})
 		}
 	}
 }
@@ -2,8 +2,17 @@ package fressian
 
 import (
 	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	tu "github.com/klingtnet/gol/util/testing"
 )
@@ -33,12 +42,16 @@ func TestWriteInt(t *testing.T) {
 	testWriteInt(t, 10)
 	testWriteInt(t, 583)
 	testWriteInt(t, 36342523521)
+	testWriteInt(t, -1)
+	testWriteInt(t, -64)
+	testWriteInt(t, math.MaxInt64)
+	testWriteInt(t, math.MinInt64)
 }
 
-func testWriteInt(t *testing.T, i int) {
+func testWriteInt(t *testing.T, i int64) {
 	buf := new(bytes.Buffer)
 	w := NewWriter(buf, nil)
-	w.WriteInt(i)
+	w.WriteInt64(i)
 	w.Flush()
 
 	tu.ExpectNil(t, w.Error())
@@ -46,7 +59,7 @@ func testWriteInt(t *testing.T, i int) {
 	r := NewReader(buf, nil)
 	val, err := r.ReadValue()
 	tu.ExpectNil(t, err)
-	tu.ExpectEqual(t, i, val)
+	tu.ExpectEqual(t, r.intValue(i), val)
 }
 
 func TestWriteValue(t *testing.T) {
@@ -61,9 +74,20 @@ func TestWriteValue(t *testing.T) {
 	testWriteValue(t, "日本語")
 	testWriteValue(t, "Hello, World!")
 	testWriteValue(t, Keyword{"hello", "world"})
+	testWriteValue(t, Symbol{"", "hello"})
 	testWriteValue(t, []interface{}{1, 2, true, 4})
 }
 
+func TestWriteArrays(t *testing.T) {
+	testWriteValue(t, []bool{true, false, true})
+	testWriteValue(t, []int32{1, -2, 2147483647, -2147483648})
+	testWriteValue(t, []int64{1, -2, 36342523521, -9223372036854775808})
+	testWriteValue(t, []float32{0, 1, 1.2345, -3.5})
+	testWriteValue(t, []float64{0, 1, 3.257329852835, -7.25})
+	testWriteValue(t, ObjectArray{1, "two", Keyword{"", "three"}})
+	testWriteValue(t, []int32{})
+}
+
 func testWriteValue(t *testing.T, val interface{}) {
 	buf := new(bytes.Buffer)
 	w := NewWriter(buf, nil)
@@ -80,6 +104,357 @@ func testWriteValue(t *testing.T, val interface{}) {
 	}
 }
 
+type point struct{ x, y int }
+
+type stringer interface{ String() string }
+
+func TestWriteHandlers(t *testing.T) {
+	handlers := NewWriteHandlers(nil)
+	RegisterWriteHandler(handlers, "point", func(w *Writer, p point) error {
+		return w.WriteExt("point", p.x, p.y)
+	})
+	RegisterWriteHandler(handlers, "", func(w *Writer, s stringer) error {
+		return w.WriteString(s.String())
+	})
+
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf, nil, WithWriteHandlers(handlers))
+	w.WriteValue([]interface{}{point{1, 2}, Keyword{"a", "b"}, 3})
+	w.WriteAs("point", point{3, 4}, false)
+	w.Flush()
+	tu.ExpectNil(t, w.Error())
+
+	r := NewReader(buf, nil)
+	expected := []interface{}{
+		[]interface{}{StructAny{"point", []interface{}{1, 2}}, ":a/b", 3},
+		StructAny{"point", []interface{}{3, 4}},
+	}
+	for _, val := range expected {
+		res, err := r.ReadValue()
+		tu.ExpectNil(t, err)
+		if !reflect.DeepEqual(val, res) {
+			t.Errorf("Expected reflect.DeepEqual(%#v, %#v)", val, res)
+		}
+	}
+
+	// the handler passed to NewWriter writes what the registry doesn't
+	double := func(w *Writer, val interface{}) error {
+		if i, ok := val.(int); ok {
+			return w.WriteInt(2 * i)
+		}
+		return DefaultHandler(w, val)
+	}
+	buf.Reset()
+	w = NewWriter(buf, double, WithWriteHandlers(handlers))
+	w.WriteValue([]interface{}{point{1, 2}, 3})
+	w.Flush()
+	tu.ExpectNil(t, w.Error())
+	res, err := NewReader(buf, nil).ReadValue()
+	tu.ExpectNil(t, err)
+	expectedList := []interface{}{StructAny{"point", []interface{}{2, 4}}, 6}
+	if !reflect.DeepEqual(expectedList, res) {
+		t.Errorf("Expected reflect.DeepEqual(%#v, %#v)", expectedList, res)
+	}
+}
+
+func TestWriteCached(t *testing.T) {
+	vals := []interface{}{
+		"hello",
+		Keyword{"hello", "world"},
+		[]interface{}{1, "two", 3},
+		map[interface{}]interface{}{"a": 1, "b": []interface{}{2}},
+	}
+
+	for _, val := range vals {
+		buf := new(bytes.Buffer)
+		w := NewWriter(buf, nil)
+		w.BeginClosedList()
+		w.WriteAs("", val, true)
+		w.WriteAs("", val, true)
+		w.WriteAs("", val, true)
+		w.EndList()
+		w.Flush()
+		tu.ExpectNil(t, w.Error())
+
+		bs := buf.Bytes()
+		tu.ExpectEqual(t, bs[1], byte(PUT_PRIORITY_CACHE))
+		tu.ExpectEqual(t, bs[len(bs)-3], byte(PRIORITY_CACHE_PACKED_START))
+		tu.ExpectEqual(t, bs[len(bs)-2], byte(PRIORITY_CACHE_PACKED_START))
+
+		r := NewReader(buf, nil)
+		res, err := r.ReadValue()
+		tu.ExpectNil(t, err)
+		expected := []interface{}{val, val, val}
+		if !reflect.DeepEqual(expected, res) {
+			t.Errorf("Expected reflect.DeepEqual(%#v, %#v)", expected, res)
+		}
+	}
+}
+
+func TestWriteCachedMany(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf, nil)
+	w.BeginClosedList()
+	for i := 0; i < 100; i++ {
+		w.WriteAs("", fmt.Sprintf("value %d", i), true)
+	}
+	for i := 99; i >= 0; i-- {
+		w.WriteAs("", fmt.Sprintf("value %d", i), true)
+	}
+	w.EndList()
+	w.Flush()
+	tu.ExpectNil(t, w.Error())
+
+	r := NewReader(buf, nil)
+	res, err := r.ReadValue()
+	tu.ExpectNil(t, err)
+	list := res.([]interface{})
+	tu.RequireEqual(t, len(list), 200)
+	for i := 0; i < 100; i++ {
+		tu.ExpectEqual(t, list[i], fmt.Sprintf("value %d", i))
+		tu.ExpectEqual(t, list[199-i], fmt.Sprintf("value %d", i))
+	}
+}
+
+func TestWriteCacheTruncate(t *testing.T) {
+	c := newWriteCache()
+	c.add("hello")
+	l := []interface{}{1}
+	c.add(l)
+	// changed after it was cached, it is still removed from the cache
+	l[0] = 2
+	c.truncate(1)
+	_, ok := c.index([]interface{}{1})
+	tu.ExpectEqual(t, ok, false)
+	_, ok = c.index(l)
+	tu.ExpectEqual(t, ok, false)
+	idx, ok := c.index("hello")
+	tu.ExpectEqual(t, ok, true)
+	tu.ExpectEqual(t, idx, 0)
+}
+
+func TestCacheLimit(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf, nil, WithCacheLimit(10, 0))
+	for i := 0; i < 100; i++ {
+		w.WriteAs("", fmt.Sprintf("value %d", i), true)
+		w.WriteAs("", fmt.Sprintf("value %d", i), true)
+		if w.cacheEntries() > 11 {
+			t.Fatalf("%d cache entries after %d values", w.cacheEntries(), i)
+		}
+	}
+	w.Flush()
+	tu.ExpectNil(t, w.Error())
+
+	r := NewReader(buf, nil)
+	for i := 0; i < 100; i++ {
+		for j := 0; j < 2; j++ {
+			res, err := r.ReadValue()
+			tu.ExpectNil(t, err)
+			tu.ExpectEqual(t, res, fmt.Sprintf("value %d", i))
+		}
+		if len(r.priorityCache) > 11 {
+			t.Fatalf("%d reader cache entries after %d values", len(r.priorityCache), i)
+		}
+	}
+
+	buf.Reset()
+	w = NewWriter(buf, nil, WithCacheLimit(0, 100))
+	w.BeginClosedList()
+	for i := 0; i < 100; i++ {
+		w.WriteAs("", fmt.Sprintf("value %d", i), true)
+		if w.cacheBytes > 100+10 {
+			t.Fatalf("%d bytes cached after %d values", w.cacheBytes, i)
+		}
+	}
+	w.EndList()
+	w.Flush()
+	tu.ExpectNil(t, w.Error())
+
+	r = NewReader(buf, nil)
+	res, err := r.ReadValue()
+	tu.ExpectNil(t, err)
+	tu.ExpectEqual(t, len(res.([]interface{})), 100)
+}
+
+func TestSplit(t *testing.T) {
+	for _, footer := range []bool{false, true} {
+		buf := new(bytes.Buffer)
+		w := NewWriter(buf, nil, WithSplit(3, 0, footer), WithAutoCache(AutoCache{Keywords: true}))
+		w.BeginOpenList()
+		records := make([]interface{}, 10)
+		for i := range records {
+			records[i] = []interface{}{Keyword{"record", "id"}, i}
+			w.WriteValue(records[i])
+		}
+		w.Flush()
+		tu.ExpectNil(t, w.Error())
+
+		bs := buf.Bytes()
+		boundaries := w.Boundaries()
+		tu.RequireEqual(t, len(boundaries), 4)
+
+		r := NewReader(bytes.NewReader(bs), nil)
+		res, err := r.ReadValue()
+		tu.ExpectNil(t, err)
+		if !reflect.DeepEqual(records, res) {
+			t.Errorf("Expected reflect.DeepEqual(%#v, %#v)", records, res)
+		}
+
+		var segmented []interface{}
+		for i, start := range boundaries {
+			end := int64(len(bs))
+			if i+1 < len(boundaries) {
+				end = boundaries[i+1]
+			}
+			r := NewReader(bytes.NewReader(bs[start:end]), nil)
+			for {
+				res, err := r.ReadValue()
+				if err == io.EOF {
+					break
+				}
+				tu.RequireNil(t, err)
+				segmented = append(segmented, res)
+			}
+		}
+		if !reflect.DeepEqual(records, segmented) {
+			t.Errorf("Expected reflect.DeepEqual(%#v, %#v)", records, segmented)
+		}
+	}
+}
+
+func TestFooter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf, nil)
+	w.WriteAs("", "hello", true)
+	w.WriteFooter()
+	w.WriteAs("", "hello", true)
+	w.WriteFooter()
+	w.Flush()
+	tu.ExpectNil(t, w.Error())
+
+	bs := buf.Bytes()
+	r := NewReader(bytes.NewReader(bs), nil)
+	for i := 0; i < 2; i++ {
+		res, err := r.ReadValue()
+		tu.ExpectNil(t, err)
+		tu.ExpectEqual(t, res, "hello")
+	}
+	_, err := r.ReadValue()
+	tu.ExpectEqual(t, err, io.EOF)
+
+	bs[2] ^= 0xff
+	r = NewReader(bytes.NewReader(bs), nil)
+	r.ReadValue()
+	_, err = r.ReadValue()
+	if err == nil {
+		t.Errorf("expected a footer checksum error")
+	}
+}
+
+func TestAutoCache(t *testing.T) {
+	record := map[interface{}]interface{}{
+		Keyword{"event", "id"}:   Keyword{"", "click"},
+		Keyword{"event", "user"}: "alice",
+		Symbol{"event", "fn"}:    "x",
+	}
+	records := []interface{}{record, record, record, record}
+
+	plain := encodedSize(t, records)
+	for _, ac := range []AutoCache{
+		{Keywords: true},
+		{Keywords: true, Symbols: true, MaxStringLength: 16},
+		{Keywords: true, Symbols: true, MaxStringLength: 16, Candidates: 2},
+	} {
+		size := encodedSize(t, records, WithAutoCache(ac))
+		if size >= plain {
+			t.Errorf("%#v: %d bytes, expected less than %d", ac, size, plain)
+		}
+	}
+}
+
+func TestAutoCacheMaxEntries(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf, nil, WithAutoCache(AutoCache{Keywords: true, MaxEntries: 10}))
+	var vals []interface{}
+	for i := 0; i < 100; i++ {
+		kw := Keyword{"ns", fmt.Sprintf("kw-%d", i)}
+		vals = append(vals, kw)
+		tu.RequireNil(t, w.WriteValue(kw))
+		if w.priorityCache.len() > 11 {
+			t.Fatalf("expected at most 11 cache entries, but got %d", w.priorityCache.len())
+		}
+	}
+	w.Flush()
+
+	r := NewReader(buf, nil)
+	for _, val := range vals {
+		res, err := r.ReadValue()
+		tu.RequireNil(t, err)
+		tu.ExpectEqual(t, res, val)
+	}
+
+	w = NewWriter(new(bytes.Buffer), nil, WithAutoCache(AutoCache{Keywords: true}))
+	tu.ExpectEqual(t, w.cacheLimit.entries, DefaultAutoCacheEntries)
+	w = NewWriter(new(bytes.Buffer), nil, WithJavaCompatible())
+	tu.ExpectEqual(t, w.cacheLimit.entries, 0)
+}
+
+func encodedSize(t *testing.T, val interface{}, opts ...Option) int {
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf, nil, opts...)
+	w.WriteValue(val)
+	w.Flush()
+	tu.ExpectNil(t, w.Error())
+	size := buf.Len()
+
+	r := NewReader(buf, nil)
+	res, err := r.ReadValue()
+	tu.ExpectNil(t, err)
+	if !reflect.DeepEqual(val, res) {
+		t.Errorf("Expected reflect.DeepEqual(%#v, %#v)", val, res)
+	}
+	return size
+}
+
+func benchmarkAutoCacheSize(b *testing.B, opts ...Option) {
+	records := make([]interface{}, 1000)
+	for i := range records {
+		records[i] = map[interface{}]interface{}{
+			Keyword{"event", "id"}:      i,
+			Keyword{"event", "type"}:    Keyword{"click", fmt.Sprintf("button-%d", i%10)},
+			Keyword{"event", "user"}:    fmt.Sprintf("user-%d", i%50),
+			Keyword{"event", "payload"}: fmt.Sprintf("payload %d", i),
+		}
+	}
+
+	size := 0
+	for i := 0; i < b.N; i++ {
+		buf := new(bytes.Buffer)
+		w := NewWriter(buf, nil, opts...)
+		w.WriteValue(records)
+		w.Flush()
+		size = buf.Len()
+	}
+	b.ReportMetric(float64(size)/float64(len(records)), "bytes/record")
+}
+
+func BenchmarkAutoCacheSizeNone(b *testing.B) {
+	benchmarkAutoCacheSize(b)
+}
+
+func BenchmarkAutoCacheSizeKeywords(b *testing.B) {
+	benchmarkAutoCacheSize(b, WithAutoCache(AutoCache{Keywords: true}))
+}
+
+func BenchmarkAutoCacheSizeStrings(b *testing.B) {
+	benchmarkAutoCacheSize(b, WithAutoCache(AutoCache{Keywords: true, MaxStringLength: 32}))
+}
+
+func BenchmarkAutoCacheSizeCandidates(b *testing.B) {
+	benchmarkAutoCacheSize(b, WithAutoCache(AutoCache{Keywords: true, MaxStringLength: 32, Candidates: 64}))
+}
+
 func TestGzipWriter(t *testing.T) {
 	buf := new(bytes.Buffer)
 
@@ -96,3 +471,416 @@ func TestGzipWriter(t *testing.T) {
 		t.Errorf("%#v != %#v", val, res)
 	}
 }
+
+func TestWriteRecord(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf, nil, WithAutoCache(AutoCache{Keywords: true}))
+	first := map[interface{}]interface{}{Keyword{"event", "id"}: 1}
+	tu.ExpectNil(t, w.WriteRecord(first))
+
+	broken := []interface{}{
+		Keyword{"event", "type"},
+		StructAny{"point", []interface{}{1, 2}},
+		map[interface{}]interface{}{Keyword{"event", "id"}: make(chan int)},
+	}
+	err := w.WriteRecord(broken)
+	tu.ExpectEqual(t, IsConversionError(err), true)
+	tu.ExpectNil(t, w.Error())
+
+	second := []interface{}{Keyword{"event", "type"}, StructAny{"point", []interface{}{3, 4}}}
+	tu.ExpectNil(t, w.WriteRecord(second))
+	w.Flush()
+
+	r := NewReader(buf, nil)
+	for _, expected := range []interface{}{first, second} {
+		res, err := r.ReadValue()
+		tu.RequireNil(t, err)
+		if !reflect.DeepEqual(expected, res) {
+			t.Errorf("Expected reflect.DeepEqual(%#v, %#v)", expected, res)
+		}
+	}
+	_, err = r.ReadValue()
+	tu.ExpectEqual(t, err, io.EOF)
+}
+
+func TestWriteCycle(t *testing.T) {
+	m := map[string]interface{}{"name": "loop"}
+	l := []interface{}{1, m}
+	m["next"] = &l
+
+	w := NewWriter(new(bytes.Buffer), nil)
+	err := w.WriteValue(l)
+	cycleErr, ok := err.(*CycleError)
+	tu.RequireEqual(t, ok, true)
+	tu.ExpectEqual(t, cycleErr.Path, "[1][next]")
+
+	shared := map[interface{}]interface{}{"shared": true}
+	val := []interface{}{shared, []interface{}{shared}, shared}
+	buf := new(bytes.Buffer)
+	w = NewWriter(buf, nil, WithSharing())
+	tu.ExpectNil(t, w.WriteValue(val))
+	w.Flush()
+	tu.ExpectEqual(t, bytes.Count(buf.Bytes(), []byte("shared")), 1)
+
+	res, err := NewReader(buf, nil).ReadValue()
+	tu.RequireNil(t, err)
+	if !reflect.DeepEqual(val, res) {
+		t.Errorf("Expected reflect.DeepEqual(%#v, %#v)", val, res)
+	}
+	l = res.([]interface{})
+	l[0].(map[interface{}]interface{})["changed"] = true
+	tu.ExpectEqual(t, l[2].(map[interface{}]interface{})["changed"], true)
+
+	// values that occur once are not put into the cache
+	unshared := []interface{}{map[string]interface{}{"a": 1}, []interface{}{"b"}}
+	plain := new(bytes.Buffer)
+	w = NewWriter(plain, nil)
+	w.WriteValue(unshared)
+	w.Flush()
+	buf.Reset()
+	w = NewWriter(buf, nil, WithSharing())
+	w.WriteValue(unshared)
+	w.Flush()
+	tu.ExpectEqual(t, buf.Len(), plain.Len())
+	tu.ExpectEqual(t, w.priorityCache.len(), 0)
+
+	// values are not shared across top-level values
+	buf.Reset()
+	w = NewWriter(buf, nil, WithSharing())
+	tu.ExpectNil(t, w.WriteValue(shared))
+	shared["shared"] = false
+	tu.ExpectNil(t, w.WriteValue(shared))
+	w.Flush()
+	r := NewReader(buf, nil)
+	for _, expected := range []bool{true, false} {
+		res, err := r.ReadValue()
+		tu.RequireNil(t, err)
+		tu.ExpectEqual(t, res.(map[interface{}]interface{})["shared"], expected)
+	}
+}
+
+func TestWriteErrors(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf, nil)
+	err := w.WriteValue([]interface{}{1, map[string]interface{}{"ch": make(chan int)}})
+	pathErr, ok := err.(*PathError)
+	tu.RequireEqual(t, ok, true)
+	tu.ExpectEqual(t, pathErr.Path, "[1][ch]")
+	tu.ExpectEqual(t, IsConversionError(err), true)
+
+	// the error is sticky and nothing is written after it
+	w.Flush()
+	n := buf.Len()
+	tu.ExpectEqual(t, w.WriteInt(1), err)
+	tu.ExpectEqual(t, w.WriteValue("more"), err)
+	tu.ExpectEqual(t, w.Flush(), err)
+	tu.ExpectEqual(t, buf.Len(), n)
+	tu.ExpectEqual(t, pathErr.Path, "[1][ch]")
+
+	w = NewWriter(failingWriter{}, nil)
+	for i := 0; i < 10000 && w.Error() == nil; i++ {
+		w.WriteValue("some string")
+	}
+	tu.ExpectEqual(t, w.Error(), errWrite)
+	tu.ExpectEqual(t, w.WriteBool(true), errWrite)
+	tu.ExpectEqual(t, w.Flush(), errWrite)
+}
+
+type myInt int16
+
+func TestWriteIntWidths(t *testing.T) {
+	vals := []interface{}{
+		-1, int8(-5), int16(math.MinInt16), int32(math.MaxInt32), int64(math.MinInt64),
+		uint8(255), uint16(math.MaxUint16), uint32(math.MaxUint32), uint(42),
+		uint64(math.MaxInt64), uintptr(7), myInt(-300),
+	}
+	expected := []int64{
+		-1, -5, math.MinInt16, math.MaxInt32, math.MinInt64,
+		255, math.MaxUint16, math.MaxUint32, 42,
+		math.MaxInt64, 7, -300,
+	}
+
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf, nil)
+	for _, val := range vals {
+		tu.RequireNil(t, w.WriteValue(val))
+	}
+	tu.RequireNil(t, w.WriteValue(uint64(math.MaxUint64)))
+	w.Flush()
+	bs := buf.Bytes()
+
+	r := NewReader(bytes.NewReader(bs), nil)
+	for _, val := range expected {
+		res, err := r.ReadValue()
+		tu.ExpectNil(t, err)
+		tu.ExpectEqual(t, res, r.intValue(val))
+	}
+	res, err := r.ReadValue()
+	tu.ExpectNil(t, err)
+	tu.ExpectEqual(t, res.(*big.Int).String(), "18446744073709551615")
+
+	r = NewReader(bytes.NewReader(bs), nil, WithInt64())
+	for _, val := range expected {
+		res, err := r.ReadValue()
+		tu.ExpectNil(t, err)
+		tu.ExpectEqual(t, res, val)
+	}
+}
+
+func TestWriteBigInt(t *testing.T) {
+	// the values from example.clj, and some around byte boundaries,
+	// with their encoding by BigInteger#toByteArray
+	cases := []struct {
+		val string
+		bs  []byte
+	}{
+		{"0", []byte{0x00}},
+		{"1", []byte{0x01}},
+		{"2", []byte{0x02}},
+		{"7", []byte{0x07}},
+		{"1000", []byte{0x03, 0xe8}},
+		{"1001", []byte{0x03, 0xe9}},
+		{"-0", []byte{0x00}},
+		{"-1", []byte{0xff}},
+		{"-2", []byte{0xfe}},
+		{"-7", []byte{0xf9}},
+		{"-1000", []byte{0xfc, 0x18}},
+		{"-1001", []byte{0xfc, 0x17}},
+		{"424242424242424242", []byte{0x05, 0xe3, 0x36, 0x3c, 0xb3, 0x9e, 0xc9, 0xb2}},
+		{"-424242424242424242", []byte{0xfa, 0x1c, 0xc9, 0xc3, 0x4c, 0x61, 0x36, 0x4e}},
+		{"127", []byte{0x7f}},
+		{"128", []byte{0x00, 0x80}},
+		{"-128", []byte{0x80}},
+		{"-129", []byte{0xff, 0x7f}},
+		{"255", []byte{0x00, 0xff}},
+		{"-256", []byte{0xff, 0x00}},
+		{"-257", []byte{0xfe, 0xff}},
+		{"9223372036854775808", []byte{0x00, 0x80, 0, 0, 0, 0, 0, 0, 0}},
+		{"-9223372036854775808", []byte{0x80, 0, 0, 0, 0, 0, 0, 0}},
+		{"18446744073709551616", []byte{0x01, 0, 0, 0, 0, 0, 0, 0, 0}},
+	}
+
+	for _, c := range cases {
+		i, ok := new(big.Int).SetString(c.val, 10)
+		tu.RequireEqual(t, ok, true)
+		encoded := []byte{BIGINT, byte(BYTES_PACKED_LENGTH_START + len(c.bs))}
+		if len(c.bs) >= BYTES_PACKED_MAX_SIZE {
+			encoded = []byte{BIGINT, BYTES, byte(len(c.bs))}
+		}
+		encoded = append(encoded, c.bs...)
+
+		for _, val := range []interface{}{i, *i} {
+			buf := new(bytes.Buffer)
+			w := NewWriter(buf, nil)
+			tu.RequireNil(t, w.WriteValue(val))
+			w.Flush()
+			if !bytes.Equal(buf.Bytes(), encoded) {
+				t.Errorf("%s: expected % x, but got % x", c.val, encoded, buf.Bytes())
+			}
+		}
+
+		res := readValue(t, encoded)
+		tu.ExpectEqual(t, res.(*big.Int).Cmp(i), 0)
+
+		bs := append([]byte(nil), c.bs...)
+		tu.ExpectEqual(t, bigIntFromBytes(bs).Cmp(i), 0)
+		if !bytes.Equal(bs, c.bs) {
+			t.Errorf("%s: decoding modified the input", c.val)
+		}
+	}
+}
+
+func TestWriteTime(t *testing.T) {
+	times := []time.Time{
+		time.Date(2015, 3, 12, 17, 53, 40, 123000000, time.UTC),
+		time.Date(1969, 12, 31, 23, 59, 59, 1000000, time.UTC),
+		time.Date(1900, 1, 1, 0, 0, 0, 999000000, time.UTC),
+		time.Unix(0, 0).UTC(),
+	}
+	for _, tm := range times {
+		buf := new(bytes.Buffer)
+		w := NewWriter(buf, nil)
+		tu.RequireNil(t, w.WriteValue(tm))
+		w.Flush()
+		bs := buf.Bytes()
+
+		res := readValue(t, bs).(time.Time)
+		tu.ExpectEqual(t, res, tm)
+
+		loc := time.FixedZone("UTC+2", 2*60*60)
+		r := NewReader(bytes.NewReader(bs), nil, WithLocation(loc))
+		res = r.readValue().(time.Time)
+		tu.ExpectEqual(t, res.Location(), loc)
+		tu.ExpectEqual(t, res.Equal(tm), true)
+	}
+
+	tm := time.Date(1969, 12, 31, 23, 59, 59, 1600000, time.UTC)
+	for _, c := range []struct {
+		rounding TimeRounding
+		millis   int64
+	}{
+		{TruncateTime, -999},
+		{RoundTime, -998},
+	} {
+		buf := new(bytes.Buffer)
+		w := NewWriter(buf, nil, WithTimeRounding(c.rounding))
+		tu.RequireNil(t, w.WriteValue(tm))
+		w.Flush()
+		res := readValue(t, buf.Bytes()).(time.Time)
+		tu.ExpectEqual(t, res.UnixMilli(), c.millis)
+	}
+
+	w := NewWriter(new(bytes.Buffer), nil, WithTimeRounding(RejectSubMillisecond))
+	tu.ExpectNil(t, w.WriteValue(times[0]))
+	tu.ExpectNotNil(t, w.WriteValue(tm))
+}
+
+func TestWriteStringSupplementary(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf, nil)
+	tu.RequireNil(t, w.WriteString("a😀b"))
+	w.Flush()
+	// U+1F600 is the surrogate pair D83D DE00
+	encoded := []byte{STRING, 0x08, 'a', 0xed, 0xa0, 0xbd, 0xed, 0xb8, 0x80, 'b'}
+	if !bytes.Equal(buf.Bytes(), encoded) {
+		t.Errorf("expected % x, but got % x", encoded, buf.Bytes())
+	}
+	tu.ExpectEqual(t, readValue(t, encoded), "a😀b")
+
+	// a lone surrogate can't be represented in Go
+	tu.ExpectEqual(t, readValue(t, []byte{STRING_PACKED_LENGTH_START + 4, 0xed, 0xa0, 0xbd, 'a'}), "\ufffda")
+
+	// chunks are split between chars, even within a surrogate pair
+	for _, n := range []int{STRING_CHUNK_MAX_SIZE - 1, STRING_CHUNK_MAX_SIZE - 3} {
+		s := strings.Repeat("a", n) + "😀"
+		buf := new(bytes.Buffer)
+		w := NewWriter(buf, nil)
+		tu.RequireNil(t, w.WriteString(s))
+		w.Flush()
+
+		bs := buf.Bytes()
+		tu.ExpectEqual(t, bs[0], byte(STRING_CHUNK))
+		res := readValue(t, bs)
+		tu.ExpectEqual(t, res, s)
+	}
+}
+
+func bigInts(ss ...string) []interface{} {
+	vals := make([]interface{}, len(ss))
+	for i, s := range ss {
+		vals[i], _ = new(big.Int).SetString(s, 10)
+	}
+	return vals
+}
+
+// TestWriteJavaCompatible compares the output of WithJavaCompatible to
+// the output of Java's FressianWriter in testdata, which `make fixtures`
+// generates using testdata/fixtures.clj.
+func TestWriteJavaCompatible(t *testing.T) {
+	point := func(x, y interface{}) StructAny {
+		return StructAny{"point", []interface{}{x, y}}
+	}
+	line := func(from, to interface{}) StructAny {
+		return StructAny{"line", []interface{}{from, to}}
+	}
+
+	fixtures := []struct {
+		name string
+		vals []interface{}
+	}{
+		{"ints", []interface{}{[]interface{}{
+			89, 33554431, 0, -1, -64, -65, 4095, -4096, 524287, -524288,
+			int64(8589934591), int64(42949672960), int64(math.MaxInt64), int64(math.MinInt64),
+		}}},
+		{"floats", []interface{}{[]interface{}{float32(1.2345), 0.0, 1.0, 3.257329852835, -2.5}}},
+		{"strings", []interface{}{[]interface{}{"", "hello", "Hello, World!", "hällo", "日本語", "a😀b", "\x00"}}},
+		{"bytes", []interface{}{[]interface{}{[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, make([]byte, 3)}}},
+		{"bigints", []interface{}{bigInts("0", "1", "2", "7", "1000", "1001",
+			"-0", "-1", "-2", "-7", "-1000", "-1001",
+			"424242424242424242", "-424242424242424242")}},
+		{"keywords", []interface{}{[]interface{}{
+			Keyword{"", "a"}, Keyword{"ns", "b"}, Keyword{"", "a"}, Keyword{"ns", "b"}, Keyword{"c", "a"},
+		}}},
+		{"structs", []interface{}{point(1, 2), point(3, 4), line(point(5, 6), point(7, 8)), line(nil, nil)}},
+		{"map", []interface{}{map[string]interface{}{"answer": 42}}},
+		{"misc", []interface{}{[]interface{}{
+			nil, true, false, time.UnixMilli(1426182819190),
+			NewUUIDFromBytes([]byte{0xf8, 0x1d, 0x4f, 0xae, 0x7d, 0xec, 0x11, 0xd0, 0xa7, 0x65, 0x00, 0xa0, 0xc9, 0x1e, 0x6b, 0xf6}),
+			[]int64{1, 2, 3},
+		}}},
+		{"lists", []interface{}{[]interface{}{
+			[]interface{}{0, 1, 2, 3, 4, 5, 6},
+			[]interface{}{0, 1, 2, 3, 4, 5, 6, 7},
+			[]interface{}{},
+		}}},
+	}
+
+	for _, f := range fixtures {
+		path := filepath.Join("testdata", f.name+".fressian")
+		expected, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			t.Fatalf("%s is missing, run `make fixtures` to generate it", path)
+		}
+		tu.RequireNil(t, err)
+
+		buf := new(bytes.Buffer)
+		w := NewWriter(buf, nil, WithJavaCompatible())
+		for _, val := range f.vals {
+			tu.RequireNil(t, w.WriteValue(val))
+		}
+		w.Flush()
+		if !bytes.Equal(buf.Bytes(), expected) {
+			t.Errorf("%s: expected % x, but got % x", f.name, expected, buf.Bytes())
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf, nil, WithFooter())
+	w.BeginOpenList()
+	w.WriteInt(1)
+	w.BeginClosedList()
+	w.WriteInt(2)
+	tu.RequireNil(t, w.Close())
+	tu.ExpectNil(t, w.Close())
+	tu.ExpectEqual(t, w.WriteInt(3), errWriteAfterClose)
+
+	r := NewReader(bytes.NewReader(buf.Bytes()), nil)
+	val, err := r.ReadValue()
+	tu.RequireNil(t, err)
+	tu.ExpectEqual(t, reflect.DeepEqual(val, []interface{}{1, []interface{}{2}}), true)
+	// a valid footer, and nothing after it
+	bs := buf.Bytes()
+	tu.ExpectEqual(t, bs[len(bs)-12], byte(FOOTER))
+	_, err = r.ReadValue()
+	tu.ExpectEqual(t, err, io.EOF)
+
+	w = NewWriter(new(bytes.Buffer), nil)
+	w.BeginList(2)
+	w.WriteInt(1)
+	err = w.Close()
+	tu.ExpectNotNil(t, err)
+	tu.ExpectEqual(t, w.Close(), err)
+
+	buf = new(bytes.Buffer)
+	gw := NewGzipWriter(buf, nil)
+	gw.WriteValue("hello")
+	tu.RequireNil(t, gw.Close())
+	gr, err := gzip.NewReader(buf)
+	tu.RequireNil(t, err)
+	_, err = io.ReadAll(gr)
+	tu.ExpectNil(t, err)
+
+	buf = new(bytes.Buffer)
+	gw = NewGzipWriter(buf, nil)
+	gw.WriteValue("hello")
+	gw.BeginList(2)
+	gw.WriteInt(1)
+	tu.ExpectNotNil(t, gw.Close())
+	gr, err = gzip.NewReader(buf)
+	if err == nil {
+		_, err = io.ReadAll(gr)
+	}
+	tu.ExpectNotNil(t, err)
+}